@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -26,6 +28,35 @@ func Getenv(env string, def string) string {
 	}
 }
 
+// Logger shared by the tools, writes to stderr so that it doesn't get mixed
+// up with data on stdout.  LOG_FORMAT selects text (the default) or json,
+// LOG_LEVEL selects debug, info (the default), warn or error.
+var Log = NewLogger(Getenv("LOG_FORMAT", "text"))
+
+// Create a logger with the given format, text or json.
+func NewLogger(format string) *slog.Logger {
+
+	var level slog.Level
+	switch strings.ToLower(Getenv("LOG_LEVEL", "info")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+
+}
+
 func StorageSignin(key []byte) (*storage.Service, error) {
 
 	// Create JWT from key file
@@ -74,79 +105,76 @@ func CloudKMSSignin(key []byte) (*cloudkms.Service, error) {
 
 }
 
-func GetGeneration(svc *storage.Service, bucket, path string, generation *int64) error {
+func GetGeneration(store ObjectStore, bucket, path string, generation *int64) error {
 
-	obj, err := svc.Objects.Get(bucket, path).Do()
+	g, err := store.Generation(bucket, path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't get object: %s\n",
-			err.Error())
+		Log.Error("Couldn't get object", "path", path, "error", err)
 		return err
 	}
 
-	*generation = obj.Generation
+	*generation = g
 
 	return nil
 
 }
 
-func Download(svc *storage.Service, bucket, path string, writer io.Writer) error {
+func Download(store ObjectStore, bucket, path string, writer io.Writer) error {
 
-	resp, err := svc.Objects.Get(bucket, path).Download()
+	r, _, err := store.Open(bucket, path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't get object: %s\n",
-			err.Error())
+		Log.Error("Couldn't get object", "path", path, "error", err)
 		return err
 	}
 
-	io.Copy(writer, resp.Body)
-	resp.Body.Close()
+	io.Copy(writer, r)
+	r.Close()
 
 	return nil
 
 }
 
-// Upload - Upload item to Google Storage
+// Upload - Upload item to storage
 // Supplying a generation number will only upload the item if the generation number
-// matches the one supplied. If there is no match, the upload will fail.
+// matches the one supplied. If there is no match, the upload will fail with
+// ErrPreconditionFailed.  Zero means the item mustn't exist yet.
 // Provide a negative generation number to upload the item without the generation check
-func Upload(svc *storage.Service, user, bucket, path string, reader io.Reader, generation int64) error {
-
-	var object storage.Object
-	object.Name = path
-	object.Kind = "storage#object"
+func Upload(store ObjectStore, user, bucket, path string, reader io.Reader, generation int64) error {
 
-	var obj *storage.Object
-	var err error
-	if generation < 0 {
-		obj, err = svc.Objects.Insert(bucket, &object).
-			Media(reader).Do()
-	} else {
-		obj, err = svc.Objects.Insert(bucket, &object).IfGenerationMatch(generation).
-			Media(reader).Do()
+	err := store.Put(bucket, path, reader, generation, nil)
+	if err != nil {
+		return err
 	}
 
+	// Ensure user can read their creds
+	Log.Info("Set policy...", "path", path)
+	err = store.Share(bucket, path, user)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Created object " + obj.Id)
+	return nil
 
-	// Ensure user can read their creds
-	var ac storage.ObjectAccessControl
-	ac.Role = "READER"
+}
 
-	fmt.Println("Set policy...")
-	_, err = svc.ObjectAccessControls.Update(bucket, path,
-		//		obj.Id,
-		"user-"+user, &ac).Do()
+// Lists users, from their directories in the bucket.
+func ListUsers(store ObjectStore, bucket string) ([]string, error) {
+
+	prefixes, err := store.ListPrefixes(bucket, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	users := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		users = append(users, strings.TrimSuffix(p, "/"))
+	}
+
+	return users, nil
 
 }
 
+// Returns a user's key ID under the original key naming, see KeyIDVersion.
 func KeyID(user string) string {
 	h := sha256.New()
 	h.Write([]byte("qK^45X/X{{]D!fTinC:"))
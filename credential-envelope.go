@@ -0,0 +1,606 @@
+package main
+
+// Encrypted envelope for credential objects, shared by the tools which
+// encode and decode objects.
+//
+// An object is an Item, JSON encoded, encrypted under the per-credential key
+// (the DEK), and hex encoded.  The binary layout is:
+//
+//   magic    "CENV"
+//   version  1 byte, envelopeVersion
+//   hdrlen   4 bytes, big-endian
+//   header   EnvelopeHeader, JSON encoded
+//   nonce    random, size depends on the cipher
+//   sealed   ciphertext and tag
+//
+// The header describes how the object was made: the cipher, and the KMS key
+// and version which wrapped the DEK, with a reference to the wrapped DEK in
+// the user's INDEX.  That's enough to decrypt the object without knowing
+// which script created it.
+//
+// Everything before the nonce, and the user the object belongs to, is
+// authenticated as associated data.  An object can't be altered, or moved to
+// another user, without decryption failing.  The object's own name isn't
+// bound, only the item name, which scripts take from their working files;
+// decode refuses an object holding an item named after another of the
+// user's objects.
+//
+// Large files are written as a stream, cipher AES-256-GCM-STREAM, so that
+// they needn't be held in memory.  After the header:
+//
+//   prefix   7 random bytes
+//   frames   each a 4 byte big-endian length and a sealed chunk
+//
+// The first chunk is the Item, without its Content.  The rest are the file
+// contents, up to chunk_size bytes each.  Each chunk's nonce is the prefix,
+// a 4 byte chunk counter and a byte which is 1 for the last chunk, so chunks
+// can't be reordered, and a truncated stream is detected.  Streams are
+// written in binary rather than hex.
+//
+// Version 1 envelopes have a fixed binary header with just the cipher and item
+// name:
+//
+//   magic "CENV", version 1, cipher 1 byte, namelen 2 bytes, name
+//
+// Objects written before the envelope existed are AES-256-CTR with a fixed
+// IV and no header.  Those are still decoded, there's a 1 in 2^32 chance of
+// one looking like an envelope, in which case decryption fails rather than
+// returning garbage.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const envelopeMagic = "CENV"
+
+// Version written.
+const envelopeVersion = 2
+
+// Ciphers.
+const (
+	cipherAESGCM       = "AES-256-GCM"
+	cipherAESGCMStream = "AES-256-GCM-STREAM"
+)
+
+// Plaintext size of each chunk in a stream.
+const streamChunkSize = 64 * 1024
+
+// Version 1 cipher identifiers.
+var v1Ciphers = map[byte]string{
+	1: cipherAESGCM,
+}
+
+// Largest header accepted, a sanity check on hdrlen.
+const maxHeaderSize = 64 * 1024
+
+// The contents of an encrypted object.
+type Item struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Content     string `json:"content,omitempty"`
+	Secret      bool   `json:"secret,omitempty"`
+}
+
+// Describes the KMS wrapping of a DEK.  Written by encode-key, and copied
+// into the header of objects encrypted under the DEK.
+type KeyInfo struct {
+
+	// Crypto key resource name.
+	KMSKey string `json:"kms_key,omitempty"`
+
+	// Crypto key version which wrapped the DEK.
+	KMSKeyVersion string `json:"kms_key_version,omitempty"`
+
+	// Where to find the wrapped DEK.
+	WrappedKey *WrappedKeyRef `json:"wrapped_key,omitempty"`
+}
+
+// Reference to a wrapped DEK.
+type WrappedKeyRef struct {
+
+	// Storage object holding the wrapped DEK, in the user's area.
+	Object string `json:"object"`
+
+	// SHA-256 of the wrapped DEK, hex encoded as stored in the INDEX "key"
+	// field, to pick out the right entry.  Once rotate-ckms has re-wrapped
+	// the DEK this no longer matches, and the entry is found by name.
+	SHA256 string `json:"sha256"`
+}
+
+type EnvelopeHeader struct {
+
+	// Format version, from the binary header.
+	Version int `json:"-"`
+
+	Cipher string `json:"cipher"`
+
+	// Item name.
+	Name string `json:"name"`
+
+	// For streams, the largest chunk of plaintext.
+	ChunkSize int `json:"chunk_size,omitempty"`
+
+	// May be empty, if the DEK wasn't wrapped by encode-key.
+	KeyInfo
+}
+
+// Returns a reference to a wrapped DEK, given its hex encoding.
+func NewWrappedKeyRef(object string, wrapped []byte) *WrappedKeyRef {
+	sum := sha256.Sum256(bytes.TrimSpace(wrapped))
+	return &WrappedKeyRef{Object: object, SHA256: hex.EncodeToString(sum[:])}
+}
+
+// Reads a KeyInfo file written by encode-key.
+func ReadKeyInfo(path string) (*KeyInfo, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var info KeyInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, errors.New("Couldn't parse key info: " + err.Error())
+	}
+
+	return &info, nil
+
+}
+
+// Reads a hex-encoded AES key, as written by generate-key.
+func readHexKey(path string) ([]byte, error) {
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	aeskey, err := hex.DecodeString(strings.TrimSpace(string(key)))
+	if err != nil {
+		return nil, errors.New("Couldn't decode key: " + err.Error())
+	}
+
+	return aeskey, nil
+
+}
+
+// Associated data: the header and the user.
+func envelopeAD(header []byte, user string) []byte {
+	ad := append([]byte{}, header...)
+	ad = append(ad, 0)
+	return append(ad, user...)
+}
+
+// Encrypts an item for a user, returns the envelope.  info describes the
+// DEK's wrapping, and may be nil.
+func SealItem(key []byte, user string, item *Item, info *KeyInfo) ([]byte, error) {
+
+	plaintext, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := &EnvelopeHeader{Cipher: cipherAESGCM, Name: item.Name}
+	if info != nil {
+		hdr.KeyInfo = *info
+	}
+
+	header, err := encodeEnvelopeHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := envelopeAD(header, user)
+
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, plaintext, ad), nil
+
+}
+
+// Returns the binary form of a header.
+func encodeEnvelopeHeader(hdr *EnvelopeHeader) ([]byte, error) {
+
+	hj, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	header := bytes.NewBufferString(envelopeMagic)
+	header.WriteByte(envelopeVersion)
+	binary.Write(header, binary.BigEndian, uint32(len(hj)))
+	header.Write(hj)
+
+	return header.Bytes(), nil
+
+}
+
+// True if data starts with an envelope header.
+func IsEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+// Parses an envelope header.  Returns the header and its length in bytes.
+func ParseEnvelopeHeader(data []byte) (*EnvelopeHeader, int, error) {
+	hdr, raw, err := ReadEnvelopeHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	return hdr, len(raw), nil
+}
+
+// Reads an envelope header.  Returns the header and the bytes it was read
+// from, which are needed to authenticate the rest of the envelope.
+func ReadEnvelopeHeader(r io.Reader) (*EnvelopeHeader, []byte, error) {
+
+	raw := make([]byte, len(envelopeMagic)+1)
+	_, err := io.ReadFull(r, raw)
+	if err != nil || !IsEnvelope(raw) {
+		return nil, nil, errors.New("Not an envelope")
+	}
+
+	// Reads n more bytes of header.
+	more := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, errors.New("Envelope header truncated")
+		}
+		raw = append(raw, b...)
+		return b, nil
+	}
+
+	switch raw[len(envelopeMagic)] {
+
+	case 1:
+		b, err := more(3)
+		if err != nil {
+			return nil, nil, err
+		}
+		cipher, ok := v1Ciphers[b[0]]
+		if !ok {
+			return nil, nil, errors.New("Unsupported cipher")
+		}
+		name, err := more(int(binary.BigEndian.Uint16(b[1:3])))
+		if err != nil {
+			return nil, nil, err
+		}
+		hdr := &EnvelopeHeader{
+			Version: 1,
+			Cipher:  cipher,
+			Name:    string(name),
+		}
+		return hdr, raw, nil
+
+	case 2:
+		b, err := more(4)
+		if err != nil {
+			return nil, nil, err
+		}
+		hdrlen := int(binary.BigEndian.Uint32(b))
+		if hdrlen > maxHeaderSize {
+			return nil, nil, errors.New("Envelope header too large")
+		}
+		hj, err := more(hdrlen)
+		if err != nil {
+			return nil, nil, err
+		}
+		var hdr EnvelopeHeader
+		err = json.Unmarshal(hj, &hdr)
+		if err != nil {
+			return nil, nil, errors.New("Couldn't parse envelope header: " +
+				err.Error())
+		}
+		hdr.Version = 2
+		return &hdr, raw, nil
+
+	}
+
+	return nil, nil, errors.New("Unsupported envelope version")
+
+}
+
+// Decrypts an object belonging to a user, returns the Item JSON.  Legacy
+// objects are decrypted without authentication.
+func OpenItem(key []byte, user string, data []byte) ([]byte, error) {
+
+	if !IsEnvelope(data) {
+		return openLegacy(key, data)
+	}
+
+	hdr, hdrlen, err := ParseEnvelopeHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Cipher != cipherAESGCM {
+		return nil, errors.New("Unsupported cipher " + hdr.Cipher)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < hdrlen+aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("Envelope truncated")
+	}
+
+	header := data[:hdrlen]
+	nonce := data[hdrlen : hdrlen+aead.NonceSize()]
+	sealed := data[hdrlen+aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, sealed,
+		envelopeAD(header, user))
+	if err != nil {
+		return nil, errors.New("Decryption failed, wrong key or user, " +
+			"or object has been tampered with")
+	}
+
+	// The name in the header is authenticated, but check the item agrees.
+	var item Item
+	err = json.Unmarshal(plaintext, &item)
+	if err != nil {
+		return nil, errors.New("Couldn't parse item: " + err.Error())
+	}
+	if item.Name != hdr.Name {
+		return nil, errors.New("Item name doesn't match envelope")
+	}
+
+	return plaintext, nil
+
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decrypts a legacy object, AES-CTR with the counter starting at 138.
+func openLegacy(key []byte, data []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	iv[aes.BlockSize-1] = 138
+
+	plaintext := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, data)
+
+	return plaintext, nil
+
+}
+
+// Encrypts an item for a user as a stream, with the content read from r.
+// item.Content is ignored.  info may be nil.
+func SealStream(w io.Writer, key []byte, user string, item *Item, info *KeyInfo, r io.Reader) error {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	hdr := &EnvelopeHeader{
+		Cipher:    cipherAESGCMStream,
+		Name:      item.Name,
+		ChunkSize: streamChunkSize,
+	}
+	if info != nil {
+		hdr.KeyInfo = *info
+	}
+
+	header, err := encodeEnvelopeHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	meta := *item
+	meta.Content = ""
+	mj, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+	if len(mj) > streamChunkSize {
+		return errors.New("Item description too large")
+	}
+
+	prefix := make([]byte, aead.NonceSize()-5)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(header, prefix...))
+	if err != nil {
+		return err
+	}
+
+	s := &chunkStream{aead: aead, prefix: prefix,
+		ad: envelopeAD(header, user)}
+
+	err = s.writeFrame(w, mj, false)
+	if err != nil {
+		return err
+	}
+
+	// Read a chunk ahead, to know which is the last.
+	br := bufio.NewReaderSize(r, streamChunkSize)
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, perr := br.Peek(1)
+		last := err != nil || perr == io.EOF
+		err = s.writeFrame(w, buf[:n], last)
+		if err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+
+}
+
+// Decrypts a stream belonging to a user, writing the content to w.  hdr and
+// raw are the header, as returned by ReadEnvelopeHeader, and r is positioned
+// after it.  Chunks are written as they're authenticated, so on error, what's
+// been written so far shouldn't be used.
+func OpenStream(key []byte, user string, hdr *EnvelopeHeader, raw []byte, r io.Reader, w io.Writer) (*Item, error) {
+
+	if hdr.Cipher != cipherAESGCMStream {
+		return nil, errors.New("Not a stream")
+	}
+
+	// The header isn't authenticated until the first chunk opens, so the
+	// chunk size it gives mustn't size any allocation beyond our own.
+	if hdr.ChunkSize <= 0 || hdr.ChunkSize > streamChunkSize {
+		return nil, errors.New("Bad stream chunk size")
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, aead.NonceSize()-5)
+	_, err = io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, errors.New("Stream truncated")
+	}
+
+	s := &chunkStream{aead: aead, prefix: prefix,
+		ad: envelopeAD(raw, user)}
+
+	mj, last, err := s.readFrame(r, hdr.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if last {
+		return nil, errors.New("Stream truncated")
+	}
+
+	var item Item
+	err = json.Unmarshal(mj, &item)
+	if err != nil {
+		return nil, errors.New("Couldn't parse item: " + err.Error())
+	}
+	if item.Name != hdr.Name {
+		return nil, errors.New("Item name doesn't match envelope")
+	}
+
+	for !last {
+		var chunk []byte
+		chunk, last, err = s.readFrame(r, hdr.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(chunk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Nothing should follow the last chunk.
+	n, _ := r.Read(make([]byte, 1))
+	if n != 0 {
+		return nil, errors.New("Data after end of stream")
+	}
+
+	return &item, nil
+
+}
+
+// Seals and opens the chunks of a stream, in order.
+type chunkStream struct {
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+	count  uint32
+}
+
+// Nonce for the next chunk.
+func (s *chunkStream) nonce(last bool) []byte {
+	nonce := append([]byte{}, s.prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, s.count)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (s *chunkStream) writeFrame(w io.Writer, chunk []byte, last bool) error {
+
+	sealed := s.aead.Seal(nil, s.nonce(last), chunk, s.ad)
+	s.count++
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))
+	_, err := w.Write(append(frame, sealed...))
+	return err
+
+}
+
+// Reads and opens the next chunk, returns it and whether it's the last.
+func (s *chunkStream) readFrame(r io.Reader, chunkSize int) ([]byte, bool, error) {
+
+	lb := make([]byte, 4)
+	_, err := io.ReadFull(r, lb)
+	if err != nil {
+		return nil, false, errors.New("Stream truncated")
+	}
+
+	size := int(binary.BigEndian.Uint32(lb))
+	if size > chunkSize+s.aead.Overhead() {
+		return nil, false, errors.New("Stream chunk too large")
+	}
+
+	sealed := make([]byte, size)
+	_, err = io.ReadFull(r, sealed)
+	if err != nil {
+		return nil, false, errors.New("Stream truncated")
+	}
+
+	// Try as a middle chunk, then as the last.
+	for _, last := range []bool{false, true} {
+		chunk, err := s.aead.Open(nil, s.nonce(last), sealed, s.ad)
+		if err == nil {
+			s.count++
+			return chunk, last, nil
+		}
+	}
+
+	return nil, false, errors.New("Decryption failed, wrong key or user, " +
+		"or object has been tampered with")
+
+}
@@ -0,0 +1,763 @@
+package main
+
+// A user's INDEX, describing their credentials.  There's an entry for each
+// credential, of one of the types below, identified within its type by its
+// device or name.
+//
+// An INDEX is read as either JSON Lines, one entry per line, or a single
+// JSON document:
+//
+//   {"version": 1, "entries": [...]}
+//
+// INDEX_FORMAT picks which is written, jsonl (the default, which clients
+// have always read) or json.  Entries are checked as they're put, and
+// fields which aren't part of an entry's type are refused.  Entries already
+// in an INDEX are written back as they were read, fields their type doesn't
+// have and all, even if they wouldn't pass those checks now.  Lines which
+// aren't JSON objects at all are warned of, and kept as they are.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry types.
+const (
+	IndexVPN        = "vpn"
+	IndexWeb        = "web"
+	IndexProbe      = "probe"
+	IndexVPNService = "vpn-service"
+)
+
+// Version of the JSON document format.
+const indexVersion = 1
+
+type IndexEntry interface {
+
+	// The entry's type, one of the Index constants.
+	Type() string
+
+	// Identifies the entry amongst others of its type.
+	ID() string
+
+	// The hex-encoded wrapped data key, as written by encode-key.
+	WrappedKey() string
+	SetWrappedKey(key string)
+
+	// Names of the objects holding the credential, relative to the user.
+	Objects() []string
+
+	// Checks the entry is complete.
+	Validate() error
+
+	// The fields every entry has.
+	Common() *IndexCommon
+}
+
+// Fields every entry has.  Start and end are the certificate's validity,
+// as openssl prints them.
+type IndexCommon struct {
+	Kind        string `json:"type"`
+	Description string `json:"description"`
+	Key         string `json:"key"`
+	Start       string `json:"start"`
+	End         string `json:"end"`
+
+	// Fields the entry's type doesn't have, kept as they were read.
+	extra map[string]json.RawMessage
+}
+
+func (c *IndexCommon) Type() string             { return c.Kind }
+func (c *IndexCommon) WrappedKey() string       { return c.Key }
+func (c *IndexCommon) SetWrappedKey(key string) { c.Key = key }
+func (c *IndexCommon) Common() *IndexCommon     { return c }
+
+func (c *IndexCommon) validate() error {
+
+	if c.Key == "" {
+		return errors.New("no key")
+	}
+
+	_, err := hex.DecodeString(c.Key)
+	if err != nil {
+		return errors.New("key isn't hex")
+	}
+
+	return nil
+
+}
+
+// A VPN device's configurations, one for each region.
+type VPNEntry struct {
+	IndexCommon
+	Device     string `json:"device"`
+	DeviceType string `json:"device_type"`
+	US         string `json:"us"`
+	UK         string `json:"uk"`
+}
+
+func (e *VPNEntry) ID() string        { return e.Device }
+func (e *VPNEntry) Objects() []string { return []string{e.US, e.UK} }
+
+func (e *VPNEntry) Validate() error {
+	return validateEntry(e, e.IndexCommon.validate())
+}
+
+// A web client certificate bundle and its password.
+type WebEntry struct {
+	IndexCommon
+	Name     string `json:"name"`
+	Bundle   string `json:"bundle"`
+	Password string `json:"password"`
+}
+
+func (e *WebEntry) ID() string        { return e.Name }
+func (e *WebEntry) Objects() []string { return []string{e.Bundle, e.Password} }
+
+func (e *WebEntry) Validate() error {
+	return validateEntry(e, e.IndexCommon.validate())
+}
+
+// A probe certificate bundle, its password, and where the probe delivers
+// to.
+type ProbeEntry struct {
+	IndexCommon
+	Name     string `json:"name"`
+	Bundle   string `json:"bundle"`
+	Password string `json:"password"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+}
+
+func (e *ProbeEntry) ID() string        { return e.Name }
+func (e *ProbeEntry) Objects() []string { return []string{e.Bundle, e.Password} }
+
+func (e *ProbeEntry) Validate() error {
+
+	err := validateEntry(e, e.IndexCommon.validate())
+	if err != nil {
+		return err
+	}
+
+	if e.Port != "" {
+		_, err = strconv.ParseUint(e.Port, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%s %s: bad port: %s", e.Kind, e.Name, e.Port)
+		}
+	}
+
+	return nil
+
+}
+
+// A VPN service's certificate bundle, password, OpenVPN parameters and
+// probe key.
+type VPNServiceEntry struct {
+	IndexCommon
+	Name      string `json:"name"`
+	Bundle    string `json:"bundle"`
+	Password  string `json:"password"`
+	DH        string `json:"dh"`
+	TA        string `json:"ta"`
+	Host      string `json:"host"`
+	Allocator string `json:"allocator"`
+	ProbeKey  string `json:"probekey"`
+}
+
+func (e *VPNServiceEntry) ID() string { return e.Name }
+
+func (e *VPNServiceEntry) Objects() []string {
+	return []string{e.Bundle, e.Password, e.DH, e.TA, e.ProbeKey}
+}
+
+func (e *VPNServiceEntry) Validate() error {
+	return validateEntry(e, e.IndexCommon.validate())
+}
+
+// An entry which can't be decoded as its type: an unknown type, or a field
+// of the wrong kind.  It's written back as it was read, apart from its key
+// if that's re-wrapped, and never passes Validate.  Data which isn't a JSON
+// object at all is opaque, and written back exactly as it was read.
+type RawEntry struct {
+	IndexCommon
+	id     string
+	fields map[string]json.RawMessage
+	opaque []byte
+	err    error
+}
+
+func (e *RawEntry) ID() string        { return e.id }
+func (e *RawEntry) Objects() []string { return nil }
+
+func (e *RawEntry) Validate() error {
+	if e.opaque != nil {
+		return fmt.Errorf("unreadable entry: %s", e.err)
+	}
+	return fmt.Errorf("%s %s: %s", e.Kind, e.id, e.err)
+}
+
+func (e *RawEntry) MarshalJSON() ([]byte, error) {
+
+	fields := map[string]json.RawMessage{}
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+
+	if e.Key != "" {
+		key, err := json.Marshal(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		fields["key"] = key
+	}
+
+	return json.Marshal(fields)
+
+}
+
+// Returns a field's value if it's a string, otherwise "".
+func rawString(fields map[string]json.RawMessage, name string) string {
+	var s string
+	if json.Unmarshal(fields[name], &s) != nil {
+		return ""
+	}
+	return s
+}
+
+// Checks what all entries need: an ID, a key, and the objects they name.
+func validateEntry(e IndexEntry, err error) error {
+
+	if e.ID() == "" {
+		return errors.New(e.Type() + ": no device or name")
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", e.Type(), e.ID(), err)
+	}
+
+	for _, o := range e.Objects() {
+		if o == "" {
+			return fmt.Errorf("%s %s: missing object name", e.Type(),
+				e.ID())
+		}
+	}
+
+	return nil
+
+}
+
+// Returns an empty entry of a type.
+func newIndexEntry(kind string) (IndexEntry, error) {
+
+	switch kind {
+	case IndexVPN:
+		return &VPNEntry{}, nil
+	case IndexWeb:
+		return &WebEntry{}, nil
+	case IndexProbe:
+		return &ProbeEntry{}, nil
+	case IndexVPNService:
+		return &VPNServiceEntry{}, nil
+	default:
+		return nil, errors.New("Unknown INDEX entry type: " + kind)
+	}
+
+}
+
+// Decodes an entry, refusing fields its type doesn't have.
+func DecodeIndexEntry(data []byte) (IndexEntry, error) {
+
+	var head struct {
+		Type string `json:"type"`
+	}
+	err := json.Unmarshal(data, &head)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := newIndexEntry(head.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+
+}
+
+// Decodes an entry as read from an INDEX.  Fields its type doesn't have are
+// kept, and an entry which can't be decoded as its type is kept as a
+// RawEntry, so that rewriting the INDEX loses nothing.  That includes data
+// which isn't a JSON object at all, which is kept opaque.
+func readIndexEntry(data []byte) (IndexEntry, error) {
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err == nil && fields == nil {
+		err = errors.New("entry isn't an object")
+	}
+	if err != nil {
+		return &RawEntry{opaque: data, err: err}, nil
+	}
+
+	kind := rawString(fields, "type")
+
+	entry, err := newIndexEntry(kind)
+	if err == nil {
+		err = json.Unmarshal(data, entry)
+	}
+	if err != nil {
+		id := rawString(fields, "device")
+		if id == "" {
+			id = rawString(fields, "name")
+		}
+		return &RawEntry{
+			IndexCommon: IndexCommon{
+				Kind:        kind,
+				Description: rawString(fields, "description"),
+				Key:         rawString(fields, "key"),
+				Start:       rawString(fields, "start"),
+				End:         rawString(fields, "end"),
+			},
+			id:     id,
+			fields: fields,
+			err:    err,
+		}, nil
+	}
+
+	// The type's own fields, as the decoder matches them.
+	data, err = json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	var known map[string]json.RawMessage
+	err = json.Unmarshal(data, &known)
+	if err != nil {
+		return nil, err
+	}
+
+	c := entry.Common()
+	for k, v := range fields {
+		isKnown := false
+		for f := range known {
+			if strings.EqualFold(k, f) {
+				isKnown = true
+			}
+		}
+		if !isKnown {
+			if c.extra == nil {
+				c.extra = map[string]json.RawMessage{}
+			}
+			c.extra[k] = v
+		}
+	}
+
+	return entry, nil
+
+}
+
+// Encodes an entry as it's written to an INDEX, with any fields kept from
+// when it was read.
+func marshalIndexEntry(e IndexEntry) ([]byte, error) {
+
+	// One from a document may span lines, which JSON Lines can't hold.
+	if r, ok := e.(*RawEntry); ok && r.opaque != nil {
+		if !bytes.Contains(r.opaque, []byte("\n")) {
+			return r.opaque, nil
+		}
+		var out bytes.Buffer
+		err := json.Compact(&out, r.opaque)
+		return out.Bytes(), err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	extra := e.Common().extra
+	if len(extra) == 0 {
+		return data, nil
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		fields[k] = v
+	}
+
+	return json.Marshal(fields)
+
+}
+
+// Makes an entry of a type from field values, keyed by their JSON names.
+func NewIndexEntry(kind string, fields map[string]string) (IndexEntry, error) {
+
+	values := map[string]string{"type": kind}
+	for k, v := range fields {
+		if k == "type" {
+			return nil, errors.New("type can't be given as a field")
+		}
+		values[k] = v
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := DecodeIndexEntry(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, entry.Validate()
+
+}
+
+// Returns an entry's string fields, keyed by their JSON names.
+func IndexEntryFields(e IndexEntry) (map[string]string, error) {
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{}
+	for k, v := range raw {
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			fields[k] = s
+		}
+	}
+
+	return fields, nil
+
+}
+
+// Parses an entry's start or end date, as openssl prints them, or RFC3339.
+func ParseIndexDate(d string) (time.Time, error) {
+
+	t, err := time.Parse("Jan _2 15:04:05 2006 MST", d)
+	if err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err = time.Parse(time.RFC3339, d)
+	if err != nil {
+		return time.Time{}, errors.New("Couldn't parse date: " + d)
+	}
+
+	return t.UTC(), nil
+
+}
+
+type Index struct {
+	Entries []IndexEntry
+}
+
+// The JSON document form.
+type indexDocument struct {
+	Version int               `json:"version"`
+	Entries []json.RawMessage `json:"entries"`
+}
+
+// Parses an INDEX in either format.  An empty INDEX has no entries.
+func ParseIndex(data []byte) (*Index, error) {
+	return parseIndex(data, true)
+}
+
+// Parses an INDEX, warning of opaque entries if asked to.
+func parseIndex(data []byte, warn bool) (*Index, error) {
+
+	ix := &Index{}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return ix, nil
+	}
+
+	// A document has entries, and an entry has a type.
+	var probe map[string]json.RawMessage
+	if json.Unmarshal(trimmed, &probe) == nil && probe["entries"] != nil &&
+		probe["type"] == nil {
+
+		var doc indexDocument
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&doc)
+		if err != nil {
+			return nil, errors.New("Couldn't parse INDEX: " + err.Error())
+		}
+
+		if doc.Version != indexVersion {
+			return nil, fmt.Errorf("Unsupported INDEX version %d",
+				doc.Version)
+		}
+
+		for i, raw := range doc.Entries {
+			entry, err := readIndexEntry(raw)
+			if err != nil {
+				return nil, fmt.Errorf("INDEX entry %d: %s", i+1, err)
+			}
+			if warn {
+				warnOpaque(entry, "entry", i+1)
+			}
+			ix.Entries = append(ix.Entries, entry)
+		}
+
+		return ix, nil
+
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry, err := readIndexEntry([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("INDEX line %d: %s", i+1, err)
+		}
+		if warn {
+			warnOpaque(entry, "line", i+1)
+		}
+		ix.Entries = append(ix.Entries, entry)
+
+	}
+
+	return ix, nil
+
+}
+
+// Warns of an entry kept opaque, which no client can read.
+func warnOpaque(e IndexEntry, where string, n int) {
+	if r, ok := e.(*RawEntry); ok && r.opaque != nil {
+		Log.Warn("INDEX "+where+" isn't a JSON object, keeping it as it is",
+			where, n, "error", r.err)
+	}
+}
+
+// Reads a user's INDEX, and returns its generation.  A user without one has
+// no entries, and generation 0.
+func ReadIndex(store ObjectStore, bucket, user string) (*Index, int64, error) {
+
+	r, generation, err := store.Open(bucket, user+"/INDEX")
+	if err == ErrObjectNotFound {
+		return &Index{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	index, err := ParseIndex(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return index, generation, nil
+
+}
+
+// Returns the entry of a type with an ID, or nil.
+func (ix *Index) Find(kind, id string) IndexEntry {
+
+	for _, e := range ix.Entries {
+		if e.Type() == kind && e.ID() == id {
+			return e
+		}
+	}
+
+	return nil
+
+}
+
+// Adds an entry, replacing the one of the same type and ID.  Returns
+// whether one was replaced.
+func (ix *Index) Put(entry IndexEntry) bool {
+
+	for i, e := range ix.Entries {
+		if e.Type() == entry.Type() && e.ID() == entry.ID() {
+			ix.Entries[i] = entry
+			return true
+		}
+	}
+
+	ix.Entries = append(ix.Entries, entry)
+	return false
+
+}
+
+// Removes entries of a type whose fields have exactly the values given,
+// e.g. {"device": "mac"}.  Returns how many were removed.  Entries which
+// couldn't be decoded as their type are matched on their string fields.
+func (ix *Index) Remove(kind string, match map[string]string) (int, error) {
+
+	entry, err := newIndexEntry(kind)
+	if err != nil {
+		return 0, err
+	}
+	fields, err := IndexEntryFields(entry)
+	if err != nil {
+		return 0, err
+	}
+	for k := range match {
+		if _, ok := fields[k]; !ok {
+			return 0, fmt.Errorf("%s entries have no %s field", kind, k)
+		}
+	}
+
+	var kept []IndexEntry
+	removed := 0
+
+	for _, e := range ix.Entries {
+
+		if e.Type() != kind {
+			kept = append(kept, e)
+			continue
+		}
+
+		fields, err := IndexEntryFields(e)
+		if err != nil {
+			return 0, err
+		}
+
+		matches := true
+		for k, v := range match {
+			if fields[k] != v {
+				matches = false
+			}
+		}
+
+		if matches {
+			removed++
+		} else {
+			kept = append(kept, e)
+		}
+
+	}
+
+	ix.Entries = kept
+	return removed, nil
+
+}
+
+// Returns the distinct objects named by entries, sorted.
+func (ix *Index) Objects() []string {
+
+	seen := map[string]bool{}
+	var objects []string
+	for _, e := range ix.Entries {
+		for _, o := range e.Objects() {
+			if !seen[o] {
+				seen[o] = true
+				objects = append(objects, o)
+			}
+		}
+	}
+
+	sort.Strings(objects)
+	return objects
+
+}
+
+// Encodes the INDEX in the INDEX_FORMAT format.  Entries aren't checked
+// here, new ones are checked as they're made, and ones which were read are
+// written back as they were.  A document can't hold an entry which isn't
+// JSON, so an INDEX with one is written as JSON Lines.  The result is
+// parsed again before it's returned, so that nothing is written which
+// can't be read back.
+func (ix *Index) Marshal() ([]byte, error) {
+
+	var out bytes.Buffer
+
+	format := Getenv("INDEX_FORMAT", "jsonl")
+	if format == "json" {
+		for _, e := range ix.Entries {
+			if r, ok := e.(*RawEntry); ok && r.opaque != nil &&
+				!json.Valid(r.opaque) {
+				Log.Warn("INDEX has an entry which isn't JSON, " +
+					"writing JSON Lines")
+				format = "jsonl"
+				break
+			}
+		}
+	}
+
+	switch format {
+
+	case "jsonl":
+		for _, e := range ix.Entries {
+			data, err := marshalIndexEntry(e)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(data)
+			out.WriteString("\n")
+		}
+
+	case "json":
+		doc := indexDocument{
+			Version: indexVersion,
+			Entries: []json.RawMessage{},
+		}
+		for _, e := range ix.Entries {
+			data, err := marshalIndexEntry(e)
+			if err != nil {
+				return nil, err
+			}
+			doc.Entries = append(doc.Entries, data)
+		}
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		out.Write(data)
+		out.WriteString("\n")
+
+	default:
+		return nil, errors.New("Unknown INDEX_FORMAT: " + format)
+
+	}
+
+	check, err := parseIndex(out.Bytes(), false)
+	if err != nil {
+		return nil, errors.New("INDEX doesn't read back: " + err.Error())
+	}
+	if len(check.Entries) != len(ix.Entries) {
+		return nil, errors.New("INDEX doesn't read back: entries lost")
+	}
+
+	return out.Bytes(), nil
+
+}
@@ -0,0 +1,402 @@
+package main
+
+// Google Cloud KMS key manager.
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Attempts at updating a key's policy, if someone else changes it under us.
+const policyAttempts = 5
+
+type cloudKeyManager struct {
+	svc *cloudkms.Service
+}
+
+func (m *cloudKeyManager) KeyExists(name string) (bool, error) {
+
+	_, err := m.svc.Projects.Locations.KeyRings.CryptoKeys.Get(name).Do()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+		return false, nil
+	}
+	if err != nil {
+		Log.Error("CryptoKey get failed", "error", err)
+		return false, err
+	}
+
+	return true, nil
+
+}
+
+func (m *cloudKeyManager) CreateKey(name string, spec *KeySpec, labels map[string]string) error {
+
+	keyRing := Getenv("KEY_RING", "")
+
+	i := strings.Index(name, "/cryptoKeys/")
+	if i < 0 {
+		return fmt.Errorf("Not a crypto key name: %s", name)
+	}
+	ringName := name[:i]
+	cryptoKey := name[i+len("/cryptoKeys/"):]
+
+	Log.Info("Check for keyring...", "keyring", keyRing,
+		"location", spec.Location)
+	_, err := m.svc.Projects.Locations.KeyRings.
+		Get(ringName).Do()
+	if err != nil {
+		Log.Error("KeyRing get failed", "error", err)
+		Log.Info("Maybe key ring does not exist", "keyring", keyRing,
+			"location", spec.Location)
+		return err
+	}
+
+	Log.Info("Key ring exists")
+
+	// New keys rotate on a schedule.  KMS makes a new primary version,
+	// rotate-ckms re-wraps data keys under it.
+	rotation, err := time.ParseDuration(Getenv("KEY_ROTATION_PERIOD",
+		"2160h"))
+	if err != nil {
+		Log.Error("Couldn't parse KEY_ROTATION_PERIOD", "error", err)
+		return err
+	}
+
+	ck := cloudkms.CryptoKey{
+		Purpose:        "ENCRYPT_DECRYPT",
+		RotationPeriod: fmt.Sprintf("%ds", int64(rotation.Seconds())),
+		NextRotationTime: time.Now().Add(rotation).UTC().
+			Format(time.RFC3339),
+		VersionTemplate: &cloudkms.CryptoKeyVersionTemplate{
+			Algorithm:       spec.Algorithm,
+			ProtectionLevel: spec.ProtectionLevel,
+		},
+		Labels: labels,
+	}
+
+	Log.Info("Create crypto key...", "location", spec.Location,
+		"protection_level", spec.ProtectionLevel,
+		"algorithm", spec.Algorithm)
+	_, err = m.svc.Projects.Locations.KeyRings.CryptoKeys.
+		Create(ringName, &ck).CryptoKeyId(cryptoKey).Do()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == 409 {
+		Log.Info("Crypto key already exists")
+		return nil
+	}
+	if err != nil {
+		Log.Error("CryptoKey create failed", "error", err)
+		return err
+	}
+
+	return nil
+
+}
+
+func (m *cloudKeyManager) Labels(name string) (map[string]string, error) {
+
+	key, err := m.svc.Projects.Locations.KeyRings.CryptoKeys.Get(name).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	return key.Labels, nil
+
+}
+
+func (m *cloudKeyManager) Grant(name, user string, isSa bool) error {
+
+	serviceAccount := Getenv("SERVICE_ACCOUNT", "")
+
+	Log.Info("Set IAM policy on crypto key...")
+	err := mergePolicy(m.svc, name,
+		desiredBindings(user, isSa, serviceAccount))
+	if err != nil {
+		Log.Error("CryptoKey SetIamPolicy failed", "error", err)
+		return err
+	}
+
+	return nil
+
+}
+
+func (m *cloudKeyManager) Encrypt(name string, plaintext []byte) ([]byte, string, error) {
+
+	resp, err := m.svc.Projects.Locations.KeyRings.CryptoKeys.
+		Encrypt(name, &cloudkms.EncryptRequest{
+			Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+		}).Do()
+	if err != nil {
+		return nil, "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ciphertext, resp.Name, nil
+
+}
+
+func (m *cloudKeyManager) Decrypt(name string, ciphertext []byte) ([]byte, error) {
+
+	resp, err := m.svc.Projects.Locations.KeyRings.CryptoKeys.
+		Decrypt(name, &cloudkms.DecryptRequest{
+			Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+		}).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+
+}
+
+func (m *cloudKeyManager) Rotate(name string) (string, error) {
+
+	Log.Info("Create crypto key version...")
+	v, err := m.svc.Projects.Locations.KeyRings.CryptoKeys.
+		CryptoKeyVersions.
+		Create(name, &cloudkms.CryptoKeyVersion{}).Do()
+	if err != nil {
+		Log.Error("CryptoKeyVersion create failed", "error", err)
+		return "", err
+	}
+
+	// Version ID is the last part of the name.
+	id := v.Name[strings.LastIndex(v.Name, "/")+1:]
+
+	Log.Info("Set primary version...", "version", v.Name)
+	_, err = m.svc.Projects.Locations.KeyRings.CryptoKeys.
+		UpdatePrimaryVersion(name,
+			&cloudkms.UpdateCryptoKeyPrimaryVersionRequest{
+				CryptoKeyVersionId: id,
+			}).Do()
+	if err != nil {
+		Log.Error("CryptoKey UpdatePrimaryVersion failed", "error", err)
+		return "", err
+	}
+
+	return v.Name, nil
+
+}
+
+// Versions which can still be used, or are disabled.
+func (m *cloudKeyManager) liveVersions(name string) ([]*cloudkms.CryptoKeyVersion, error) {
+
+	var live []*cloudkms.CryptoKeyVersion
+
+	err := m.svc.Projects.Locations.KeyRings.CryptoKeys.
+		CryptoKeyVersions.List(name).Pages(context.Background(),
+		func(res *cloudkms.ListCryptoKeyVersionsResponse) error {
+			for _, v := range res.CryptoKeyVersions {
+				if v.State != "DESTROYED" &&
+					v.State != "DESTROY_SCHEDULED" {
+					live = append(live, v)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		Log.Error("CryptoKey list failed", "error", err)
+		return nil, err
+	}
+
+	return live, nil
+
+}
+
+func (m *cloudKeyManager) Versions(name string) ([]string, error) {
+
+	live, err := m.liveVersions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(live))
+	for _, v := range live {
+		names = append(names, v.Name)
+	}
+
+	return names, nil
+
+}
+
+// Cloud KMS destroys versions after the key's scheduled destruction
+// duration, until then they can be restored.
+func (m *cloudKeyManager) Destroy(name string) ([]*ScheduledDestruction, error) {
+
+	Log.Info("List crypto keys...", "key", name)
+	live, err := m.liveVersions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var scheduled []*ScheduledDestruction
+
+	for _, v := range live {
+
+		Log.Info("Delete...", "version", v.Name)
+
+		res, err := m.svc.Projects.Locations.KeyRings.CryptoKeys.
+			CryptoKeyVersions.
+			Destroy(v.Name,
+				&cloudkms.DestroyCryptoKeyVersionRequest{}).Do()
+		if err != nil {
+			Log.Error("CryptoKey Destroy failed", "error", err)
+			return scheduled, err
+		}
+
+		Log.Info("Success", "destroy_time", res.DestroyTime)
+		scheduled = append(scheduled, &ScheduledDestruction{
+			Version:     res.Name,
+			DestroyTime: res.DestroyTime,
+		})
+
+	}
+
+	return scheduled, nil
+
+}
+
+// Bindings a user's key must have, role to members:
+// - User can use key to decrypt.
+// - Cred Service Account can use key to encrypt.
+func desiredBindings(user string, isSa bool, serviceAccount string) map[string][]string {
+
+	var uString string
+	if isSa {
+		uString = "serviceAccount:" + user
+	} else {
+		uString = "user:" + user
+	}
+
+	return map[string][]string{
+		"roles/cloudkms.cryptoKeyDecrypter": {uString},
+		"roles/cloudkms.cryptoKeyEncrypter": {
+			"serviceAccount:" + serviceAccount,
+		},
+	}
+
+}
+
+// Adds the desired bindings to a crypto key's policy, leaving any others an
+// admin has added alone.  The policy's etag guards against concurrent
+// changes, if it's changed under us, start again.
+func mergePolicy(svc *cloudkms.Service, resourceName string, desired map[string][]string) error {
+
+	var err error
+	for attempt := 1; attempt <= policyAttempts; attempt++ {
+
+		var pol *cloudkms.Policy
+		pol, err = getPolicy(svc, resourceName)
+		if err != nil {
+			return err
+		}
+
+		missing, _ := policyDrift(pol, desired)
+		if len(missing) == 0 {
+			Log.Info("Policy already up to date")
+			return nil
+		}
+
+		for role, members := range missing {
+			addMembers(pol, role, members)
+		}
+
+		// Etag is carried over from the policy we read.
+		_, err = svc.Projects.Locations.KeyRings.CryptoKeys.
+			SetIamPolicy(resourceName, &cloudkms.SetIamPolicyRequest{
+				Policy: pol,
+			}).Do()
+		if err == nil {
+			return nil
+		}
+
+		// Etag mismatch is reported as 409 Aborted.
+		if e, ok := err.(*googleapi.Error); !ok || e.Code != 409 {
+			return err
+		}
+
+		Log.Info("Policy changed, retrying", "attempt", attempt)
+
+	}
+
+	return err
+
+}
+
+func getPolicy(svc *cloudkms.Service, resourceName string) (*cloudkms.Policy, error) {
+
+	// Version 3 so that conditional bindings survive the round trip.
+	return svc.Projects.Locations.KeyRings.CryptoKeys.
+		GetIamPolicy(resourceName).OptionsRequestedPolicyVersion(3).Do()
+
+}
+
+// Compares a policy to the desired bindings.  Returns members missing from
+// the policy, and members in the policy which aren't desired, by role.
+// Conditional bindings don't count towards the desired bindings, as they
+// may not always apply.
+func policyDrift(pol *cloudkms.Policy, desired map[string][]string) (map[string][]string, map[string][]string) {
+
+	actual := map[string]map[string]bool{}
+	extra := map[string][]string{}
+
+	for _, b := range pol.Bindings {
+
+		want := map[string]bool{}
+		for _, m := range desired[b.Role] {
+			want[m] = true
+		}
+
+		for _, m := range b.Members {
+			if b.Condition == nil {
+				if actual[b.Role] == nil {
+					actual[b.Role] = map[string]bool{}
+				}
+				actual[b.Role][m] = true
+			}
+			if !want[m] || b.Condition != nil {
+				extra[b.Role] = append(extra[b.Role], m)
+			}
+		}
+
+	}
+
+	missing := map[string][]string{}
+	for role, members := range desired {
+		for _, m := range members {
+			if !actual[role][m] {
+				missing[role] = append(missing[role], m)
+			}
+		}
+	}
+
+	return missing, extra
+
+}
+
+// Adds members to the unconditional binding for a role, creating it if
+// needed.
+func addMembers(pol *cloudkms.Policy, role string, members []string) {
+
+	for _, b := range pol.Bindings {
+		if b.Role == role && b.Condition == nil {
+			b.Members = append(b.Members, members...)
+			return
+		}
+	}
+
+	pol.Bindings = append(pol.Bindings, &cloudkms.Binding{
+		Role:    role,
+		Members: members,
+	})
+
+}
@@ -0,0 +1,482 @@
+package main
+
+// Local key manager, for testing without Cloud KMS.  Each key is a JSON file
+// under KMS_LOCAL_DIR, at the key's resource name, holding its versions.
+// Version keys are sealed with a master key derived from
+// KMS_LOCAL_PASSPHRASE, so the directory can be kept alongside test data.
+//
+// There's no access control, anyone with the passphrase can use every key.
+//
+// Destroying a version schedules it for destruction after
+// KMS_LOCAL_DESTROY_DELAY (default 24h), the version key is wiped the first
+// time the key is used after that.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PBKDF2 iterations deriving the master key.
+const localKeyIterations = 100000
+
+// Largest key file read.  Key files hold a few sealed version keys.
+const maxLocalKeyFile = 1024 * 1024
+
+type localKeyManager struct {
+	dir    string
+	master []byte
+}
+
+type localKeyVersion struct {
+	// Version key, sealed under the master key.
+	Sealed      []byte `json:"sealed,omitempty"`
+	DestroyTime string `json:"destroy_time,omitempty"`
+	Destroyed   bool   `json:"destroyed,omitempty"`
+}
+
+type localKey struct {
+	ProtectionLevel string             `json:"protection_level"`
+	Algorithm       string             `json:"algorithm"`
+	Labels          map[string]string  `json:"labels,omitempty"`
+	Primary         int                `json:"primary"`
+	Versions        []*localKeyVersion `json:"versions"`
+}
+
+func newLocalKeyManager() (*localKeyManager, error) {
+
+	dir := Getenv("KMS_LOCAL_DIR", "kms")
+	passphrase := Getenv("KMS_LOCAL_PASSPHRASE", "")
+	if passphrase == "" {
+		return nil, errors.New("KMS_LOCAL_PASSPHRASE not set")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// The salt is made the first time the directory is used.
+	saltFile := filepath.Join(dir, "SALT")
+	salt, err := ioutil.ReadFile(saltFile)
+	if os.IsNotExist(err) {
+		salt = make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err == nil {
+			err = ioutil.WriteFile(saltFile, salt, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	master := pbkdf2.Key([]byte(passphrase), salt, localKeyIterations, 32,
+		sha256.New)
+
+	return &localKeyManager{dir: dir, master: master}, nil
+
+}
+
+// Path of a key's file.  Names come from records and envelope headers, so
+// mustn't be able to point outside the directory.
+func (m *localKeyManager) path(name string) (string, error) {
+
+	if !strings.HasPrefix(name, "projects/") {
+		return "", fmt.Errorf("Not a crypto key name: %s", name)
+	}
+	for _, p := range strings.Split(name, "/") {
+		if p == "" || p == "." || p == ".." {
+			return "", fmt.Errorf("Not a crypto key name: %s", name)
+		}
+	}
+
+	return filepath.Join(m.dir, filepath.FromSlash(name)) + ".json", nil
+
+}
+
+func (m *localKeyManager) load(name string) (*localKey, error) {
+
+	path, err := m.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxLocalKeyFile+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxLocalKeyFile {
+		return nil, fmt.Errorf("Key file over %d bytes: %s",
+			maxLocalKeyFile, path)
+	}
+
+	var key localKey
+	err = json.Unmarshal(data, &key)
+	if err != nil {
+		return nil, errors.New("Couldn't parse key file: " + err.Error())
+	}
+
+	// Wipe versions whose destruction is due.
+	now := time.Now().UTC().Format(time.RFC3339)
+	purged := false
+	for _, v := range key.Versions {
+		if !v.Destroyed && v.DestroyTime != "" && v.DestroyTime <= now {
+			v.Sealed = nil
+			v.Destroyed = true
+			purged = true
+		}
+	}
+	if purged {
+		err = m.save(name, &key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &key, nil
+
+}
+
+// Writes a key file, via a temporary file so that a key is never half
+// written.
+func (m *localKeyManager) save(name string, key *localKey) error {
+
+	path, err := m.path(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+
+}
+
+// Seals with AES-GCM, the nonce is prepended to the ciphertext.
+func localSeal(key, plaintext, ad []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, ad), nil
+
+}
+
+func localOpen(key, sealed, ad []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("Ciphertext too short")
+	}
+
+	n := gcm.NonceSize()
+	return gcm.Open(nil, sealed[:n], sealed[n:], ad)
+
+}
+
+// Adds a new version to a key, with a fresh random version key.
+func (m *localKeyManager) addVersion(name string, key *localKey) error {
+
+	vkey := make([]byte, 32)
+	_, err := rand.Read(vkey)
+	if err != nil {
+		return err
+	}
+
+	version := len(key.Versions) + 1
+	sealed, err := localSeal(m.master, vkey,
+		[]byte(keyVersionName(name, version)))
+	if err != nil {
+		return err
+	}
+
+	key.Versions = append(key.Versions, &localKeyVersion{Sealed: sealed})
+	key.Primary = version
+
+	return nil
+
+}
+
+// Returns a version's key.
+func (m *localKeyManager) versionKey(name string, key *localKey, version int) ([]byte, error) {
+
+	if version < 1 || version > len(key.Versions) {
+		return nil, fmt.Errorf("No version %d of %s", version, name)
+	}
+
+	v := key.Versions[version-1]
+	if v.Destroyed {
+		return nil, fmt.Errorf("Version %d of %s is destroyed", version,
+			name)
+	}
+	if v.DestroyTime != "" {
+		return nil, fmt.Errorf("Version %d of %s is scheduled for "+
+			"destruction", version, name)
+	}
+
+	vkey, err := localOpen(m.master, v.Sealed,
+		[]byte(keyVersionName(name, version)))
+	if err != nil {
+		return nil, errors.New("Couldn't unseal key, wrong passphrase?")
+	}
+
+	return vkey, nil
+
+}
+
+func (m *localKeyManager) KeyExists(name string) (bool, error) {
+
+	_, err := m.load(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+
+}
+
+func (m *localKeyManager) CreateKey(name string, spec *KeySpec, labels map[string]string) error {
+
+	if spec.ProtectionLevel != "SOFTWARE" ||
+		spec.Algorithm != "GOOGLE_SYMMETRIC_ENCRYPTION" {
+		return fmt.Errorf("Local KMS doesn't support %s %s keys",
+			spec.ProtectionLevel, spec.Algorithm)
+	}
+
+	exists, err := m.KeyExists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		Log.Info("Crypto key already exists")
+		return nil
+	}
+
+	key := &localKey{
+		ProtectionLevel: spec.ProtectionLevel,
+		Algorithm:       spec.Algorithm,
+		Labels:          labels,
+	}
+
+	err = m.addVersion(name, key)
+	if err != nil {
+		return err
+	}
+
+	Log.Info("Create crypto key...", "key", name)
+	return m.save(name, key)
+
+}
+
+func (m *localKeyManager) Labels(name string) (map[string]string, error) {
+
+	key, err := m.load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.Labels, nil
+
+}
+
+func (m *localKeyManager) Grant(name, user string, isSa bool) error {
+	Log.Info("Local KMS has no access control, not granting access",
+		"user", user)
+	return nil
+}
+
+// Ciphertext is the version number, then the data sealed under that version.
+func (m *localKeyManager) Encrypt(name string, plaintext []byte) ([]byte, string, error) {
+
+	err := checkKMSSize("Plaintext", plaintext, maxKMSPlaintext)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := m.load(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	vkey, err := m.versionKey(name, key, key.Primary)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(key.Primary))
+
+	sealed, err := localSeal(vkey, plaintext, []byte(name))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return append(hdr, sealed...), keyVersionName(name, key.Primary), nil
+
+}
+
+func (m *localKeyManager) Decrypt(name string, ciphertext []byte) ([]byte, error) {
+
+	if len(ciphertext) < 4 {
+		return nil, errors.New("Ciphertext too short")
+	}
+
+	err := checkKMSSize("Ciphertext", ciphertext, maxKMSCiphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	// The passphrase is checked, by unsealing the version key, before the
+	// ciphertext is opened.
+	key, err := m.load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	version := int(binary.BigEndian.Uint32(ciphertext[:4]))
+	vkey, err := m.versionKey(name, key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := localOpen(vkey, ciphertext[4:], []byte(name))
+	if err != nil {
+		return nil, errors.New("Couldn't decrypt: " + err.Error())
+	}
+
+	return plaintext, nil
+
+}
+
+func (m *localKeyManager) Rotate(name string) (string, error) {
+
+	key, err := m.load(name)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.addVersion(name, key)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.save(name, key)
+	if err != nil {
+		return "", err
+	}
+
+	version := keyVersionName(name, key.Primary)
+	Log.Info("Set primary version...", "version", version)
+
+	return version, nil
+
+}
+
+func (m *localKeyManager) Versions(name string) ([]string, error) {
+
+	key, err := m.load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for i, v := range key.Versions {
+		if !v.Destroyed && v.DestroyTime == "" {
+			names = append(names, keyVersionName(name, i+1))
+		}
+	}
+
+	return names, nil
+
+}
+
+func (m *localKeyManager) Destroy(name string) ([]*ScheduledDestruction, error) {
+
+	delay, err := time.ParseDuration(Getenv("KMS_LOCAL_DESTROY_DELAY",
+		"24h"))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := m.load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	when := time.Now().Add(delay).UTC().Format(time.RFC3339)
+
+	var scheduled []*ScheduledDestruction
+	for i, v := range key.Versions {
+		if v.Destroyed || v.DestroyTime != "" {
+			continue
+		}
+		version := keyVersionName(name, i+1)
+		Log.Info("Delete...", "version", version, "destroy_time", when)
+		v.DestroyTime = when
+		scheduled = append(scheduled, &ScheduledDestruction{
+			Version:     version,
+			DestroyTime: when,
+		})
+	}
+
+	return scheduled, m.save(name, key)
+
+}
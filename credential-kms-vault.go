@@ -0,0 +1,309 @@
+package main
+
+// HashiCorp Vault Transit key manager.  Talks to VAULT_ADDR with VAULT_TOKEN,
+// using the Transit engine mounted at VAULT_TRANSIT_PATH (default transit).
+//
+// Transit keys are named by the last part of the resource name, the user's
+// key ID, so locations don't apply.  Transit keys don't have labels.  Who can
+// use which key is up to Vault policies, which are managed outside the
+// provisioner.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest response read from Vault, and the most of a refusal read for its
+// error message.
+const (
+	maxVaultResponse = 1024 * 1024
+	maxVaultError    = 4096
+)
+
+type vaultKeyManager struct {
+	addr   string
+	token  string
+	mount  string
+	client *http.Client
+}
+
+// Error returned by Vault.
+type vaultError struct {
+	Code   int
+	Errors []string
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("Vault returned %d: %s", e.Code,
+		strings.Join(e.Errors, ", "))
+}
+
+func newVaultKeyManager() (*vaultKeyManager, error) {
+
+	addr := Getenv("VAULT_ADDR", "")
+	token := Getenv("VAULT_TOKEN", "")
+	if addr == "" || token == "" {
+		return nil, errors.New("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+
+	return &vaultKeyManager{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		mount:  Getenv("VAULT_TRANSIT_PATH", "transit"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+
+}
+
+// Transit key name for a resource name.
+func vaultKeyName(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// Makes a request of the Transit engine.  If out isn't nil, the response's
+// data is decoded into it.
+func (m *vaultKeyManager) request(method, path string, in, out interface{}) error {
+
+	var body bytes.Buffer
+	if in != nil {
+		err := json.NewEncoder(&body).Encode(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	url := m.addr + "/v1/" + m.mount + "/" + path
+	req, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", m.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A refusal, bad token say, is dealt with before any more than its
+	// error message is read.
+	if resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxVaultError))
+		e := &vaultError{Code: resp.StatusCode}
+		json.Unmarshal(data, e)
+		return e
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxVaultResponse+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxVaultResponse {
+		return fmt.Errorf("Vault response over %d bytes", maxVaultResponse)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	var wrapper struct {
+		Data json.RawMessage `json:"data"`
+	}
+	err = json.Unmarshal(data, &wrapper)
+	if err != nil {
+		return errors.New("Couldn't parse Vault response: " + err.Error())
+	}
+
+	return json.Unmarshal(wrapper.Data, out)
+
+}
+
+func (m *vaultKeyManager) KeyExists(name string) (bool, error) {
+
+	err := m.request("GET", "keys/"+vaultKeyName(name), nil, nil)
+	if e, ok := err.(*vaultError); ok && e.Code == 404 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+
+}
+
+func (m *vaultKeyManager) CreateKey(name string, spec *KeySpec, labels map[string]string) error {
+
+	if spec.Algorithm != "GOOGLE_SYMMETRIC_ENCRYPTION" {
+		return errors.New("Vault Transit keys are AES-256-GCM, not " +
+			spec.Algorithm)
+	}
+
+	if spec.ProtectionLevel != "SOFTWARE" {
+		Log.Warn("Protection level is up to Vault's seal, ignoring",
+			"protection_level", spec.ProtectionLevel)
+	}
+
+	// Creating a key which exists leaves it alone.
+	Log.Info("Create crypto key...", "key", vaultKeyName(name))
+	return m.request("POST", "keys/"+vaultKeyName(name),
+		map[string]interface{}{"type": "aes256-gcm96"}, nil)
+
+}
+
+func (m *vaultKeyManager) Labels(name string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (m *vaultKeyManager) Grant(name, user string, isSa bool) error {
+	Log.Info("Vault access is managed by Vault policies, not granting "+
+		"access", "user", user)
+	return nil
+}
+
+// Ciphertext is Vault's, e.g. vault:v1:..., which includes the version.
+func (m *vaultKeyManager) Encrypt(name string, plaintext []byte) ([]byte, string, error) {
+
+	err := checkKMSSize("Plaintext", plaintext, maxKMSPlaintext)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+		KeyVersion int    `json:"key_version"`
+	}
+
+	err = m.request("POST", "encrypt/"+vaultKeyName(name),
+		map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+		}, &resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return []byte(resp.Ciphertext), keyVersionName(name, resp.KeyVersion),
+		nil
+
+}
+
+func (m *vaultKeyManager) Decrypt(name string, ciphertext []byte) ([]byte, error) {
+
+	err := checkKMSSize("Ciphertext", ciphertext, maxKMSCiphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+
+	err = m.request("POST", "decrypt/"+vaultKeyName(name),
+		map[string]interface{}{
+			"ciphertext": string(ciphertext),
+		}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+
+}
+
+func (m *vaultKeyManager) Rotate(name string) (string, error) {
+
+	err := m.request("POST", "keys/"+vaultKeyName(name)+"/rotate", nil,
+		nil)
+	if err != nil {
+		return "", err
+	}
+
+	var key struct {
+		LatestVersion int `json:"latest_version"`
+	}
+	err = m.request("GET", "keys/"+vaultKeyName(name), nil, &key)
+	if err != nil {
+		return "", err
+	}
+
+	version := keyVersionName(name, key.LatestVersion)
+	Log.Info("Set primary version...", "version", version)
+
+	return version, nil
+
+}
+
+func (m *vaultKeyManager) Versions(name string) ([]string, error) {
+
+	var key struct {
+		Keys map[string]interface{} `json:"keys"`
+	}
+	err := m.request("GET", "keys/"+vaultKeyName(name), nil, &key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions are keyed by number, older ones may have been trimmed.
+	var ids []int
+	for k := range key.Keys {
+		id, err := strconv.Atoi(k)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	var names []string
+	for _, id := range ids {
+		names = append(names, keyVersionName(name, id))
+	}
+
+	return names, nil
+
+}
+
+// Transit can't schedule destruction, so the key is deleted straight away,
+// once deletion is allowed.
+func (m *vaultKeyManager) Destroy(name string) ([]*ScheduledDestruction, error) {
+
+	versions, err := m.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.request("POST", "keys/"+vaultKeyName(name)+"/config",
+		map[string]interface{}{"deletion_allowed": true}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	Log.Info("Delete...", "key", vaultKeyName(name))
+	err = m.request("DELETE", "keys/"+vaultKeyName(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	var scheduled []*ScheduledDestruction
+	for _, v := range versions {
+		scheduled = append(scheduled, &ScheduledDestruction{
+			Version:     v,
+			DestroyTime: now,
+		})
+	}
+
+	return scheduled, nil
+
+}
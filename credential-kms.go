@@ -0,0 +1,371 @@
+package main
+
+// Where users' keys live, what kind of keys they are, and the key managers
+// which hold them.
+//
+// KMS_BACKEND picks the key manager:
+//
+//   cloudkms  Google Cloud KMS, the default
+//   local     Keys in files, sealed under a passphrase, for testing
+//             (see credential-kms-local.go)
+//   vault     HashiCorp Vault's Transit engine (see credential-kms-vault.go)
+//
+// Whichever is used, keys are named by their Cloud KMS style resource name.
+//
+// Key defaults come from the environment:
+//
+//   KMS_LOCATION          Key location, default global
+//   KMS_PROTECTION_LEVEL  SOFTWARE (the default) or HSM
+//   KMS_ALGORITHM         Default GOOGLE_SYMMETRIC_ENCRYPTION
+//
+// KMS_KEY_CONFIG names a JSON file overriding those for particular users or
+// email domains, a user's entry taking precedence over their domain's:
+//
+//   {
+//     "domains": {
+//       "trustnetworks.co.uk": {"location": "europe-west2",
+//                               "protection_level": "HSM"}
+//     },
+//     "users": {
+//       "someone@trustnetworks.com": {"location": "europe-west2"}
+//     }
+//   }
+//
+// Settings only apply when setup-ckms creates a key.  The key's resource name
+// is then recorded in the user's area of the bucket, and the other tools find
+// the key from the record, so a key stays usable if the settings change.
+// Keys created before the record existed are in the global location.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// A key manager holds users' keys, and wraps data keys with them.  Keys are
+// identified by resource name, see KeyName.
+type KeyManager interface {
+
+	// Returns whether a key exists.
+	KeyExists(name string) (bool, error)
+
+	// Creates a key with the given settings and labels.  It's not an
+	// error if the key already exists.
+	CreateKey(name string, spec *KeySpec, labels map[string]string) error
+
+	// Returns a key's labels.
+	Labels(name string) (map[string]string, error)
+
+	// Gives the user permission to decrypt with their key, and the
+	// provisioner's service account permission to encrypt.
+	Grant(name, user string, isSa bool) error
+
+	// Encrypts with the key's primary version.  Returns the ciphertext and
+	// the resource name of the version used.
+	Encrypt(name string, plaintext []byte) ([]byte, string, error)
+
+	// Decrypts with whichever version of the key encrypted the ciphertext.
+	Decrypt(name string, ciphertext []byte) ([]byte, error)
+
+	// Creates a new version of the key and makes it primary.  Returns the
+	// version's resource name.
+	Rotate(name string) (string, error)
+
+	// Returns the resource names of the key's versions which haven't been
+	// destroyed, or scheduled for destruction.
+	Versions(name string) ([]string, error)
+
+	// Schedules every version of the key for destruction.  Versions can't
+	// be used once scheduled.
+	Destroy(name string) ([]*ScheduledDestruction, error)
+}
+
+// Largest plaintext Cloud KMS will encrypt, which the other backends keep to
+// as well, and the largest ciphertext they'll decrypt, allowing for their
+// encodings.  Wrapped data keys are far smaller.
+const (
+	maxKMSPlaintext  = 64 * 1024
+	maxKMSCiphertext = 2 * maxKMSPlaintext
+)
+
+// Checks a plaintext or ciphertext is within the limits above, before it's
+// sent anywhere.
+func checkKMSSize(what string, data []byte, max int) error {
+	if len(data) > max {
+		return fmt.Errorf("%s too large: %d bytes, at most %d", what,
+			len(data), max)
+	}
+	return nil
+}
+
+// A key version scheduled for destruction, and when it will be destroyed.
+type ScheduledDestruction struct {
+	Version     string `json:"version"`
+	DestroyTime string `json:"destroy_time"`
+}
+
+// Connects to the key manager picked by KMS_BACKEND.  The key is the service
+// account's private key, used by Cloud KMS.
+func KeyManagerSignin(key []byte) (KeyManager, error) {
+
+	switch backend := Getenv("KMS_BACKEND", "cloudkms"); backend {
+	case "cloudkms":
+		svc, err := CloudKMSSignin(key)
+		if err != nil {
+			return nil, err
+		}
+		return &cloudKeyManager{svc: svc}, nil
+	case "local":
+		return newLocalKeyManager()
+	case "vault":
+		return newVaultKeyManager()
+	default:
+		return nil, errors.New("Unknown KMS_BACKEND: " + backend)
+	}
+
+}
+
+// Resource name of a key version.
+func keyVersionName(name string, version int) string {
+	return fmt.Sprintf("%s/cryptoKeyVersions/%d", name, version)
+}
+
+// Object in the user's area recording their key's resource name.
+const keyRecordObject = "KMSKEY"
+
+// Settings for a user's key.
+type KeySpec struct {
+	Location        string `json:"location,omitempty"`
+	ProtectionLevel string `json:"protection_level,omitempty"`
+	Algorithm       string `json:"algorithm,omitempty"`
+}
+
+type keyConfig struct {
+	Domains map[string]*KeySpec `json:"domains,omitempty"`
+	Users   map[string]*KeySpec `json:"users,omitempty"`
+}
+
+// Fills in settings missing from s with those from o.
+func (s *KeySpec) merge(o *KeySpec) {
+	if o == nil {
+		return
+	}
+	if s.Location == "" {
+		s.Location = o.Location
+	}
+	if s.ProtectionLevel == "" {
+		s.ProtectionLevel = o.ProtectionLevel
+	}
+	if s.Algorithm == "" {
+		s.Algorithm = o.Algorithm
+	}
+}
+
+// Returns the settings for a new key for a user.
+func KeySpecFor(user string) (*KeySpec, error) {
+
+	spec := &KeySpec{}
+
+	if path := Getenv("KMS_KEY_CONFIG", ""); path != "" {
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var cfg keyConfig
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			return nil, errors.New("Couldn't parse KMS_KEY_CONFIG: " +
+				err.Error())
+		}
+
+		spec.merge(cfg.Users[user])
+		if at := strings.LastIndex(user, "@"); at >= 0 {
+			spec.merge(cfg.Domains[user[at+1:]])
+		}
+
+	}
+
+	spec.merge(&KeySpec{
+		Location:        Getenv("KMS_LOCATION", "global"),
+		ProtectionLevel: Getenv("KMS_PROTECTION_LEVEL", "SOFTWARE"),
+		Algorithm: Getenv("KMS_ALGORITHM",
+			"GOOGLE_SYMMETRIC_ENCRYPTION"),
+	})
+
+	return spec, nil
+
+}
+
+// Resource name of the key ring in a location.
+func KeyRingName(location string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/keyRings/%s",
+		Getenv("PROJECT_ID", ""), location, Getenv("KEY_RING", ""))
+}
+
+// Key naming versions.  Version 1 hashes the user with a salt compiled into
+// the binary, it's how keys were named before naming was configurable, and is
+// kept so those keys can still be found.  Version 2 is an HMAC of the user
+// keyed with KEY_ID_SALT, prefixed with the version.
+//
+// KEY_NAMING_VERSION picks the version for new keys, default 1.  Existing
+// keys keep their names, as they're recorded.
+const (
+	KeyNamingOriginal = 1
+	KeyNamingSalted   = 2
+)
+
+// Returns the naming version for new keys.
+func KeyNamingVersion() (int, error) {
+
+	version, err := strconv.Atoi(Getenv("KEY_NAMING_VERSION", "1"))
+	if err != nil {
+		return 0, errors.New("Couldn't parse KEY_NAMING_VERSION: " +
+			err.Error())
+	}
+
+	return version, nil
+
+}
+
+// Returns a user's key ID under a naming version.
+func KeyIDVersion(user string, version int) (string, error) {
+
+	switch version {
+
+	case KeyNamingOriginal:
+		return KeyID(user), nil
+
+	case KeyNamingSalted:
+		salt := Getenv("KEY_ID_SALT", "")
+		if salt == "" {
+			return "", errors.New("KEY_ID_SALT not set")
+		}
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write([]byte(user))
+		// Crypto key IDs are at most 63 characters.
+		return fmt.Sprintf("k2-%x", mac.Sum(nil))[:63], nil
+
+	default:
+		return "", fmt.Errorf("Unknown key naming version %d", version)
+
+	}
+
+}
+
+// Resource name of a new key for a user in a location, named with the
+// current naming version.
+func KeyName(user, location string) (string, error) {
+
+	version, err := KeyNamingVersion()
+	if err != nil {
+		return "", err
+	}
+
+	id, err := KeyIDVersion(user, version)
+	if err != nil {
+		return "", err
+	}
+
+	return KeyRingName(location) + "/cryptoKeys/" + id, nil
+
+}
+
+// Resource name of a key created before keys were recorded.  They're all in
+// the global location, with the original naming.
+func OriginalKeyName(user string) string {
+	return KeyRingName("global") + "/cryptoKeys/" + KeyID(user)
+}
+
+// Labels for a new key, so that keys can be traced back to users.  Label
+// values are limited to lower case letters, digits, _ and -, and 63
+// characters, so the user label is the user with anything else replaced by
+// _, for people to read.  It isn't unique, different users can have the same
+// one.  The user-hmac label, an HMAC of the full user keyed with
+// KEY_ID_SALT, is.  The full user is where the key is recorded, in
+// <user>/KMSKEY, and lookup-key -list pairs them up.
+func KeyLabels(user string) (map[string]string, error) {
+
+	version, err := KeyNamingVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	value := []rune{}
+	for _, c := range strings.ToLower(user) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '_' || c == '-' {
+			value = append(value, c)
+		} else {
+			value = append(value, '_')
+		}
+	}
+	if len(value) > 63 {
+		value = value[:63]
+	}
+
+	mac := hmac.New(sha256.New, []byte(Getenv("KEY_ID_SALT", "")))
+	mac.Write([]byte(user))
+
+	return map[string]string{
+		"user":       string(value),
+		"user-hmac":  fmt.Sprintf("%x", mac.Sum(nil))[:32],
+		"key-naming": strconv.Itoa(version),
+	}, nil
+
+}
+
+// Returns the recorded resource name of a user's key, or "" if there isn't a
+// record.
+func RecordedKeyName(store ObjectStore, user string) (string, error) {
+
+	bucket := Getenv("BUCKET", "")
+	path := user + "/" + keyRecordObject
+
+	r, _, err := store.Open(bucket, path)
+	if err == ErrObjectNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	name, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(name)), nil
+
+}
+
+// Returns the resource name of a user's key, from the record if there is
+// one, otherwise the global location used before keys were recorded.
+func ResolveKeyName(store ObjectStore, user string) (string, error) {
+
+	name, err := RecordedKeyName(store, user)
+	if err != nil {
+		return "", err
+	}
+	if name != "" {
+		return name, nil
+	}
+
+	return OriginalKeyName(user), nil
+
+}
+
+// Record the resource name of a user's key.
+func RecordKeyName(store ObjectStore, user, name string) error {
+	bucket := Getenv("BUCKET", "")
+	path := user + "/" + keyRecordObject
+	return Upload(store, user, bucket, path, bytes.NewBufferString(name), -1)
+}
@@ -7,18 +7,23 @@ package main
 // request queue is for notifying this code to create certs.  When certs are
 // created, the message is sent back down the response queue, so something
 // like a web app could monitor the queue to find out when its responses have
-// been actioned.
+// been actioned.  The same requests can be made over HTTP, see
+// provision-http.go.
 
-// FIXME: The response queue would benefit from status information, I guess.
+// Responses carry a status: on failure, a machine-readable code and the tail
+// of the script's error output.  On success, details of any certificate
+// issued.
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
-	"os/exec"
-	"regexp"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -26,19 +31,11 @@ import (
 	"google.golang.org/api/pubsub/v1"
 )
 
-//
-// Source: https://socketloop.com/tutorials/golang-validate-email-address-with-regular-expression
-//
-// Simple regex based email validity check
-func validateEmail(email string) bool {
-	Re := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
-	return Re.MatchString(email)
-}
-
 var (
-	notifyTopic  = Getenv("PUBSUB_RESPONSE_TOPIC", "credential-response")
-	requestTopic = Getenv("PUBSUB_REQUEST_TOPIC", "credential-request")
-	subscription = Getenv("PUBSUB_SUBSCRIPTION", "credential-subscription")
+	notifyTopic     = Getenv("PUBSUB_RESPONSE_TOPIC", "credential-response")
+	requestTopic    = Getenv("PUBSUB_REQUEST_TOPIC", "credential-request")
+	subscription    = Getenv("PUBSUB_SUBSCRIPTION", "credential-subscription")
+	deadLetterTopic = Getenv("PUBSUB_DEAD_LETTER_TOPIC", "credential-dead-letter")
 )
 
 // Structure for the JSON messages passed on the pub-sub.
@@ -64,12 +61,34 @@ type Message struct {
 
 	// For VPN service, a hostname providing the allocator service
 	Allocator string `json:"allocator,omitempty"`
+
+	// Optional client-supplied ID.  A request replayed with the same ID
+	// gets the original response, rather than being executed again.
+	RequestId string `json:"request_id,omitempty"`
 }
 
 type MessageResponse struct {
 	Message
 	MessageId string `json:"id"`
 	Success   bool   `json:"success"`
+
+	// Failure code e.g. validation_failed, see provision-status.go.
+	Code string `json:"code,omitempty"`
+
+	// Human-readable failure description.
+	Error string `json:"error,omitempty"`
+
+	// End of the script's error output, on failure.
+	Stderr string `json:"stderr,omitempty"`
+
+	// When processing started, and how long it took in milliseconds.
+	Started  time.Time `json:"started"`
+	Duration int64     `json:"duration"`
+
+	// Issued certificate serial number and validity period.
+	Serial    string `json:"serial,omitempty"`
+	NotBefore string `json:"notbefore,omitempty"`
+	NotAfter  string `json:"notafter,omitempty"`
 }
 
 // Sign in to Google cloud pubsub.
@@ -123,23 +142,25 @@ func maybeCreateTopic(svc *pubsub.Service, pr, topic string) error {
 		}).Do()
 	if err != nil {
 		// Create failed.
-		fmt.Println("Topic create failed.")
+		Log.Error("Topic create failed", "topic", name, "error", err)
 		return err
 	}
 
-	fmt.Println("Subscription created.")
+	Log.Info("Topic created", "topic", name)
 
 	return nil
 
 }
 
-func sendResponse(svc *pubsub.Service, msg *Message, id string, success bool, notifName string) {
-	msgResponse := MessageResponse{*msg, id, success}
+func sendResponse(svc *pubsub.Service, msgResponse *MessageResponse, notifName string) {
+
+	log := requestLog(&msgResponse.Message, msgResponse.MessageId)
 
 	bin, err := json.Marshal(msgResponse)
 	if err != nil {
-		fmt.Println("ERROR Notify failed: could not format json for response "+
-			"message, user may hang waiting for response. message: ", msgResponse)
+		log.Error("Notify failed: could not format json for response "+
+			"message, user may hang waiting for response",
+			"error", err)
 		return
 	}
 
@@ -147,7 +168,7 @@ func sendResponse(svc *pubsub.Service, msg *Message, id string, success bool, no
 
 	pr := &pubsub.PublishRequest{
 		Messages: []*pubsub.PubsubMessage{
-			&pubsub.PubsubMessage{
+			{
 				Data: encoded,
 			},
 		},
@@ -157,12 +178,298 @@ func sendResponse(svc *pubsub.Service, msg *Message, id string, success bool, no
 		notifName,
 		pr).Do()
 	if err != nil {
-		fmt.Println("ERROR Notify send failed: " + err.Error())
+		log.Error("Notify send failed", "error", err)
+	}
+}
+
+// Logger tagged with a request's details, so that a user's provisioning
+// history can be picked out of the logs.
+func requestLog(msg *Message, id string) *slog.Logger {
+	return Log.With("id", id, "user", msg.User, "type", msg.Type,
+		"identity", msg.Identity)
+}
+
+// Subscription, topics and retry state used when processing messages.
+type Provisioner struct {
+	svc            *pubsub.Service
+	subsName       string
+	notifName      string
+	deadLetterName string
+	retry          *RetryPolicy
+	attempts       *attemptCounter
+
+	// May be nil, if requests aren't deduplicated.
+	dedup DedupStore
+}
+
+// Process a received message.  On success or permanent failure, the
+// response is sent and the message acknowledged.  Transient failures are
+// redelivered after a backoff, until the retry policy gives up, at which
+// point the message goes to the dead-letter topic.
+func (p *Provisioner) deliver(m *pubsub.ReceivedMessage, msg *Message) {
+
+	id := m.Message.MessageId
+	attempt := p.attempts.Next(id)
+	log := requestLog(msg, id)
+
+	resp, replayed := p.Process(msg, id)
+
+	// Shutting down, hand the message back for another provisioner.
+	if resp.Code == CodeAborted {
+		log.Info("Request aborted by shutdown, returning it to the queue")
+		p.nack(log, m.AckId, 0)
+		return
+	}
+
+	if replayed {
+		sendResponse(p.svc, resp, p.notifName)
+		p.ack(log, m.AckId)
+		p.attempts.Done(id)
+		return
+	}
+
+	if p.retry.ShouldRetry(resp, attempt) {
+		delay := p.retry.Delay(attempt)
+		log.Warn("Attempt failed, will retry", "attempt", attempt,
+			"code", resp.Code, "delay", delay.String())
+		p.attempts.Retrying(id)
+		p.nack(log, m.AckId, delay)
+		return
+	}
+
+	if !resp.Success && IsTransient(resp.Code) {
+		log.Error("Giving up", "attempts", attempt, "code", resp.Code)
+		p.sendDeadLetter(log, m.Message, resp, attempt)
+	}
+
+	sendResponse(p.svc, resp, p.notifName)
+	p.ack(log, m.AckId)
+	p.attempts.Done(id)
+
+}
+
+// Process a request, or replay the recorded response if it's been processed
+// before.  This is the code path shared by the Pub/Sub and HTTP transports.
+func (p *Provisioner) Process(msg *Message, id string) (*MessageResponse, bool) {
+
+	log := requestLog(msg, id)
+
+	// Don't start anything new once shutdown has started.
+	if shutdown.Draining() {
+		return abortedResponse(msg, id), false
+	}
+
+	// If we can't tell whether the request has been seen before, don't
+	// risk executing it twice, treat it as a storage failure so that it's
+	// retried.
+	prev, err := p.recorded(msg)
+	if err != nil {
+		log.Error("Couldn't read dedup store", "error", err)
+		return &MessageResponse{
+			Message:   *msg,
+			MessageId: id,
+			Started:   time.Now().UTC(),
+			Code:      CodeStorageFailed,
+			Error:     "Couldn't read dedup store: " + err.Error(),
+		}, false
+	}
+
+	if prev != nil {
+		log.Info("Request already processed, replaying response",
+			"request_id", msg.RequestId)
+		observeRequest(msg, prev, true)
+		return prev, true
+	}
+
+	resp := processMessage(msg, id)
+	p.record(msg, resp)
+	observeRequest(msg, resp, false)
+
+	return resp, false
+
+}
+
+// Returns the recorded response to a request, or nil if it hasn't been
+// processed before.
+func (p *Provisioner) recorded(msg *Message) (*MessageResponse, error) {
+	key := dedupKey(msg)
+	if p.dedup == nil || key == "" {
+		return nil, nil
+	}
+	return p.dedup.Get(key)
+}
+
+// Record the response to a request.  Transient failures aren't recorded, so
+// that the request can be resubmitted.
+func (p *Provisioner) record(msg *Message, resp *MessageResponse) {
+	key := dedupKey(msg)
+	if p.dedup == nil || key == "" {
+		return
+	}
+	if !resp.Success && IsTransient(resp.Code) {
+		return
+	}
+	err := p.dedup.Put(key, resp)
+	if err != nil {
+		requestLog(msg, resp.MessageId).Error("Couldn't record response",
+			"error", err)
+	}
+}
+
+// Acknowledge a message, so it isn't redelivered.
+func (p *Provisioner) ack(log *slog.Logger, ackId string) {
+	_, err := p.svc.Projects.Subscriptions.Acknowledge(p.subsName,
+		&pubsub.AcknowledgeRequest{
+			AckIds: []string{ackId},
+		}).Do()
+	if err != nil {
+		log.Error("Ack failed", "error", err)
+	}
+}
+
+// Have a message redelivered after a delay, by setting its ack deadline.
+func (p *Provisioner) nack(log *slog.Logger, ackId string, delay time.Duration) {
+	_, err := p.svc.Projects.Subscriptions.ModifyAckDeadline(p.subsName,
+		&pubsub.ModifyAckDeadlineRequest{
+			AckIds:             []string{ackId},
+			AckDeadlineSeconds: int64(delay / time.Second),
+		}).Do()
+	if err != nil {
+		log.Error("Nack failed", "error", err)
+	}
+}
+
+// Publish a failed message to the dead-letter topic.  The data is the
+// original request payload, attributes describe the failure.
+func (p *Provisioner) sendDeadLetter(log *slog.Logger, orig *pubsub.PubsubMessage, resp *MessageResponse, attempts int) {
+
+	pr := &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{
+			{
+				Data: orig.Data,
+				Attributes: map[string]string{
+					"id":       orig.MessageId,
+					"code":     resp.Code,
+					"error":    resp.Error,
+					"stderr":   resp.Stderr,
+					"attempts": strconv.Itoa(attempts),
+				},
+			},
+		},
+	}
+
+	_, err := p.svc.Projects.Topics.Publish(p.deadLetterName, pr).Do()
+	if err != nil {
+		log.Error("Dead-letter send failed, request lost", "error", err)
+	}
+
+}
+
+// Process a request using the handler registered for its type, returning
+// the response.
+func processMessage(msg *Message, id string) *MessageResponse {
+
+	resp := &MessageResponse{
+		Message:   *msg,
+		MessageId: id,
+		Started:   time.Now().UTC(),
+	}
+
+	res, err := runHandler(requestLog(msg, id), msg)
+
+	resp.Duration = int64(time.Since(resp.Started) / time.Millisecond)
+
+	if res != nil && res.Cert != nil {
+		resp.Serial = res.Cert.Serial
+		resp.NotBefore = res.Cert.NotBefore
+		resp.NotAfter = res.Cert.NotAfter
+	}
+
+	if err != nil {
+		resp.Code = CodeExecutionFailed
+		resp.Error = err.Error()
+		if he, ok := err.(*HandlerError); ok {
+			resp.Code = he.Code
+			resp.Error = he.Message
+		}
+		if res != nil {
+			resp.Stderr = stderrTail(res.Stderr)
+		}
+		return resp
+	}
+
+	resp.Success = true
+	return resp
+
+}
+
+func runHandler(log *slog.Logger, msg *Message) (*Result, error) {
+
+	if msg.Type == "" {
+		log.Warn("Request type empty, ignored")
+		return nil, &HandlerError{CodeValidationFailed,
+			"request type not specified"}
+	}
+
+	h := LookupHandler(msg.Type)
+	if h == nil {
+		log.Warn("Request for unknown type, ignored")
+		return nil, &HandlerError{CodeUnknownType,
+			"unknown request type " + msg.Type}
+	}
+
+	if h.Validate != nil {
+		err := h.Validate(msg)
+		if err != nil {
+			log.Warn(h.Desc+": parameter validation failed",
+				"error", err)
+			return nil, err
+		}
+	}
+
+	log.Info(h.Desc)
+
+	res, err := h.Execute(msg)
+
+	if res != nil {
+		logOutput(log, "stdout", res.Stdout)
+		logOutput(log, "stderr", res.Stderr)
+	}
+
+	if err != nil {
+		log.Error(h.Desc+" failed", "error", err)
+	} else {
+		log.Info(h.Desc + " complete")
+		if h.PublishesCRL {
+			observeCRLPublished()
+		}
+	}
+
+	return res, err
+
+}
+
+// Log a child process's output, a record per line.
+func logOutput(log *slog.Logger, stream string, out []byte) {
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			log.Info(line, "stream", stream)
+		}
 	}
 }
 
 func main() {
 
+	// The provisioner's logs are JSON by default, for the log pipeline.
+	Log = NewLogger(Getenv("LOG_FORMAT", "json"))
+
+	err := shutdown.ConfigureFromEnv()
+	if err != nil {
+		Log.Error("Couldn't parse shutdown timeouts", "error", err)
+		return
+	}
+	shutdown.Notify()
+
 	request := Getenv("REQUEST_TOPIC", requestTopic)
 	notify := Getenv("NOTIFY_TOPIC", notifyTopic)
 	project := Getenv("PUBSUB_PROJECT", "")
@@ -173,42 +480,63 @@ func main() {
 	// Read the key file
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		fmt.Printf("Couldn't read key file: %s\n",
-			err.Error())
+		Log.Error("Couldn't read key file", "error", err)
 		return
 	}
 
+	// Start the HTTP server early, so that health checks can report
+	// progress.  API endpoints are added once we're ready for requests.
+	health := NewHealth()
+	mux := http.NewServeMux()
+	health.Register(mux)
+	registerMetrics(mux)
+
+	srv := &http.Server{Addr: Getenv("HTTP_ADDR", ":8080"), Handler: mux}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			Log.Error("HTTP server failed", "addr", srv.Addr,
+				"error", err)
+		}
+	}()
+
 	// Sign in to pubsub.
 	svc, err := pubsubSignin(key)
 	if err != nil {
-		fmt.Printf("Couldn't connect: %s\n",
-			err.Error())
+		Log.Error("Couldn't connect", "error", err)
 		return
 	}
 
-	fmt.Printf("Connected.\n")
+	Log.Info("Connected")
 
 	// Create the request topic.
 	err = maybeCreateTopic(svc, project, request)
 	if err != nil {
-		fmt.Printf("Couldn't create topic %s %s: %s\n",
-			project, request,
-			err.Error())
+		Log.Error("Couldn't create topic", "project", project,
+			"topic", request, "error", err)
 		return
 	}
 
 	// Create the notify topic.
 	err = maybeCreateTopic(svc, project, notify)
 	if err != nil {
-		fmt.Printf("Couldn't create topic %s %s: %s\n",
-			project, request,
-			err.Error())
+		Log.Error("Couldn't create topic", "project", project,
+			"topic", notify, "error", err)
+		return
+	}
+
+	// Create the dead-letter topic.
+	err = maybeCreateTopic(svc, project, deadLetterTopic)
+	if err != nil {
+		Log.Error("Couldn't create topic", "project", project,
+			"topic", deadLetterTopic, "error", err)
 		return
 	}
 
 	// Names for stuff for later.
 	subsName := "projects/" + project + "/subscriptions/" + subscription
 	notifName := "projects/" + project + "/topics/" + notifyTopic
+	deadLetterName := "projects/" + project + "/topics/" + deadLetterTopic
 
 	// Get the subscription.
 	_, err = svc.Projects.Subscriptions.Get(subsName).Do()
@@ -218,56 +546,103 @@ func main() {
 	if err != nil {
 
 		// Create subscription object.
+		// Scripts can take minutes to run, allow the maximum ack
+		// deadline so requests aren't redelivered while in progress.
 		s := &pubsub.Subscription{
 			Name: subsName,
 			Topic: "projects/" + project + "/topics/" +
 				requestTopic,
+			AckDeadlineSeconds: 600,
 		}
 
 		// Implement
 		_, err = svc.Projects.Subscriptions.Create(subsName, s).
 			Do()
 		if err != nil {
-			fmt.Printf("Couldn't create subscription: %s\n",
-				err.Error())
+			Log.Error("Couldn't create subscription", "error", err)
 			return
 		}
-		fmt.Println("Subscription created.")
+		Log.Info("Subscription created")
+	}
+
+	health.SetPubsub(nil)
+
+	// Refresh CRL's at boot, using the create-crls handler.
+	_, err = runHandler(Log.With("type", "boot"),
+		&Message{Type: "create-crls"})
+	health.SetBootCRLs(err)
+
+	Log.Info("Process messages")
+
+	// Worker pool, requests are processed concurrently across users.
+	workers, err := strconv.Atoi(Getenv("WORKERS", "4"))
+	if err != nil {
+		Log.Error("Couldn't parse WORKERS", "error", err)
+		return
+	}
+	batch, err := strconv.Atoi(Getenv("PULL_BATCH_SIZE", "10"))
+	if err != nil {
+		Log.Error("Couldn't parse PULL_BATCH_SIZE", "error", err)
+		return
 	}
 
-	// Refresh CRL's at boot
-	fmt.Println()
-	fmt.Println("---- Create all CRLs at boot")
+	pool := NewWorkerPool(workers)
 
-	cmdOut, err := exec.Command("./create-all-crls").
-		Output()
+	go watchExpiry()
 
+	retry, err := RetryPolicyFromEnv()
 	if err != nil {
-		fmt.Println("Error: " + err.Error())
+		Log.Error("Couldn't parse retry policy", "error", err)
+		return
 	}
 
-	fmt.Printf("%s", cmdOut)
+	dedup, err := DedupStoreFromEnv(key)
+	if err != nil {
+		Log.Error("Couldn't open dedup store", "error", err)
+		return
+	}
 
-	fmt.Println()
-	fmt.Println("---- Process Messages")
+	p := &Provisioner{
+		svc:            svc,
+		subsName:       subsName,
+		notifName:      notifName,
+		deadLetterName: deadLetterName,
+		retry:          retry,
+		attempts:       newAttemptCounter(),
+		dedup:          dedup,
+	}
 
-	// Endless loop...
-	for {
+	// Serve the HTTP API alongside Pub/Sub.
+	newAPIServer(p, pool).Register(mux)
 
-		// Pull next message.
+	// Loop until shutdown...
+	for !shutdown.Draining() {
+
+		// Only pull as many messages as there are free workers, so that
+		// messages aren't left waiting out their ack deadline.
+		free := pool.WaitFree()
+		if free > batch {
+			free = batch
+		}
+
+		// Pull next messages.
 		resp, err := svc.Projects.Subscriptions.Pull(subsName,
 			&pubsub.PullRequest{
-				MaxMessages:       1,
+				MaxMessages:       int64(free),
 				ReturnImmediately: false,
-			}).Do()
+			}).Context(shutdown.Context()).Do()
+		if err != nil && shutdown.Draining() {
+			break
+		}
+		health.SetPubsub(err)
+		observePull(err)
 		if err != nil {
-			fmt.Printf("Couldn't pull: %s\n",
-				err.Error())
+			Log.Error("Couldn't pull", "error", err)
 			time.Sleep(time.Second * 10)
 			continue
 		}
 
-		// Loop through all (1) messages...
+		// Hand messages to the pool.
 		for _, m := range resp.ReceivedMessages {
 
 			// Decode base64.
@@ -278,301 +653,30 @@ func main() {
 			// Decode JSON.
 			err = json.Unmarshal([]byte(data), &msg)
 			if err != nil {
-				fmt.Println("Couldn't make sense of message: " +
-					string(m.Message.Data))
-				fmt.Println("Ignored.")
+				Log.Warn("Couldn't make sense of message",
+					"id", m.Message.MessageId,
+					"data", m.Message.Data, "error", err)
 			}
 
-			// VPN case
-			if msg.Type == "vpn" {
-
-				if !validateEmail(msg.User) || msg.Identity == "" || len(msg.Identity) == 0 {
-					fmt.Println()
-					fmt.Println("---- Creating vpn key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-
-					fmt.Println()
-					fmt.Println("---- Creating vpn key for " +
-						msg.User + msg.Identity)
-
-					out, err := exec.Command("./create-vpn-key",
-						msg.User, msg.Identity).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-				}
-			} else if msg.Type == "web" {
-
-				// Web cert case.
-
-				if !validateEmail(msg.User) || msg.Identity == "" || len(msg.Identity) == 0 {
-					fmt.Println()
-					fmt.Println("---- Creating web key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-
-					fmt.Println()
-					fmt.Println("---- Creating web key for " +
-						msg.User + msg.Identity)
-
-					out, err := exec.Command("./create-web-key",
-						msg.User, msg.Identity).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-				}
-			} else if msg.Type == "probe" {
-
-				// Probe cert case.
-
-				if !validateEmail(msg.User) || msg.Identity == "" || len(msg.Identity) == 0 || msg.Endpoint == "" {
-					fmt.Println()
-					fmt.Println("---- Creating probe key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-
-					fmt.Println()
-					fmt.Println("---- Creating probe key for " +
-						msg.User + msg.Identity)
-
-					out, err := exec.Command("./create-probe-key",
-						msg.User, msg.Identity,
-						msg.Endpoint).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-				}
-			} else if msg.Type == "vpn-service" {
-
-				// VPN service cert case.
-
-				if !validateEmail(msg.User) || msg.Identity == "" || len(msg.Identity) == 0 || msg.Host == "" || msg.Allocator == "" || msg.ProbeCred == "" {
-					fmt.Println()
-					fmt.Println("---- Creating probe key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-
-					fmt.Println()
-					fmt.Println("---- Creating VPN service key for " +
-						msg.User + msg.Identity)
-
-					out, err := exec.Command("./create-vpn-service-key",
-						msg.User, msg.Identity,
-						msg.Host, msg.Allocator,
-						msg.ProbeCred).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-				}
-			} else if msg.Type == "revoke-vpn" {
-
-				if !validateEmail(msg.User) {
-					fmt.Println()
-					fmt.Println("---- Revoking vpn key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-
-					fmt.Println()
-					fmt.Println("---- Revoking VPN key for " +
-						msg.User + msg.Identity)
-
-					out, err := exec.Command("./revoke-vpn-key",
-						msg.User, msg.Identity).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-
-				}
-			} else if msg.Type == "revoke-web" {
-
-				// Revoke Web cert case.
-
-				if !validateEmail(msg.User) {
-					fmt.Println()
-					fmt.Println("---- Revoking vpn key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-					fmt.Println()
-					fmt.Println("---- Revoking web key for " +
-						msg.User)
-
-					out, err := exec.Command("./revoke-web-key",
-						msg.User).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-				}
-			} else if msg.Type == "revoke-probe" {
-
-				// Revoke probe cert case.
-
-				if !validateEmail(msg.User) {
-					fmt.Println()
-					fmt.Println("---- Revoking probe key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-					fmt.Println()
-					fmt.Println("---- Revoking probe key for " +
-						msg.User)
-
-					out, err := exec.Command("./revoke-probe-key",
-						msg.User).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-				}
-			} else if msg.Type == "revoke-vpn-service" {
-
-				// Revoke probe cert case.
-
-				if !validateEmail(msg.User) {
-					fmt.Println()
-					fmt.Println("---- Revoking VPN service key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-					fmt.Println()
-					fmt.Println("---- Revoking VPN service key for " +
-						msg.User)
-
-					out, err := exec.Command("./revoke-vpn-service-key",
-						msg.User).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-				}
-			} else if msg.Type == "revoke-all" {
-
-				if !validateEmail(msg.User) {
-					fmt.Println()
-					fmt.Println("---- Revoking all key: parameter validation failed")
-
-					sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
-
-				} else {
-
-					// Revoke All cert case.
-
-					fmt.Println()
-					fmt.Println("---- Revoking all vpn and web key for " +
-						msg.User)
-
-					out, err := exec.Command("./revoke-all-key",
-						msg.User).
-						Output()
-
-					if err != nil {
-						fmt.Println("Error: " + err.Error())
-					}
-
-					fmt.Printf("%s", out)
-
-					sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-				}
-			} else if msg.Type == "create-crls" {
-
-				// Create all CRLs
-
-				fmt.Println()
-				fmt.Println("---- Creating all CRLs requested")
-
-				out, err := exec.Command("./create-all-crls").
-					Output()
-
-				if err != nil {
-					fmt.Println("Error: " + err.Error())
-				}
-
-				fmt.Printf("%s", out)
-
-				sendResponse(svc, &msg, m.Message.MessageId, err == nil, notifName)
-
-			} else if msg.Type == "" {
-
-				fmt.Printf("Request type (empty) - Ignored \n")
-				sendResponse(svc, &msg, m.Message.MessageId, false, notifName)
+			m, msg := m, msg
+			pool.Submit(msg.User, func() {
+				p.deliver(m, &msg)
+			})
+		}
+	}
 
-			} else {
+	Log.Info("Stopped pulling, waiting for running requests")
+	if !shutdown.Drain(pool) {
+		Log.Error("Requests still running at shutdown")
+	}
 
-				fmt.Printf("Request for unknown type (%s)?\n",
-					msg.Type)
-				fmt.Println("Ignored.")
-			}
+	// Running requests are done, so synchronous HTTP clients have had
+	// their responses.
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
 
-			// Acknowledge the message
-			_, err = svc.Projects.Subscriptions.Acknowledge(subsName,
-				&pubsub.AcknowledgeRequest{
-					AckIds: []string{
-						m.AckId,
-					},
-				}).Do()
-			if err != nil {
-				fmt.Println("Ack: " + err.Error())
-			}
-		}
-	}
+	Log.Info("Shutdown complete")
 
 }
@@ -0,0 +1,129 @@
+package main
+
+// Google Cloud Storage object store.
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+type gcsObjectStore struct {
+	svc *storage.Service
+}
+
+// Turns Cloud Storage's not found and precondition errors into ours.
+func gcsError(err error) error {
+	if e, ok := err.(*googleapi.Error); ok {
+		switch e.Code {
+		case 404:
+			return ErrObjectNotFound
+		case 412:
+			return ErrPreconditionFailed
+		}
+	}
+	return err
+}
+
+func (s *gcsObjectStore) Generation(bucket, path string) (int64, error) {
+
+	obj, err := s.svc.Objects.Get(bucket, path).Do()
+	if err != nil {
+		return 0, gcsError(err)
+	}
+
+	return obj.Generation, nil
+
+}
+
+func (s *gcsObjectStore) Open(bucket, path string) (io.ReadCloser, int64, error) {
+
+	resp, err := s.svc.Objects.Get(bucket, path).Download()
+	if err != nil {
+		return nil, 0, gcsError(err)
+	}
+
+	generation, _ := strconv.ParseInt(resp.Header.Get("X-Goog-Generation"),
+		10, 64)
+
+	return resp.Body, generation, nil
+
+}
+
+func (s *gcsObjectStore) Put(bucket, path string, r io.Reader, generation int64, attrs *ObjectAttrs) error {
+
+	var object storage.Object
+	object.Name = path
+	object.Kind = "storage#object"
+	if attrs != nil {
+		object.ContentType = attrs.ContentType
+		object.CacheControl = attrs.CacheControl
+	}
+
+	call := s.svc.Objects.Insert(bucket, &object)
+	if generation >= 0 {
+		call = call.IfGenerationMatch(generation)
+	}
+
+	obj, err := call.Media(r).Do()
+	if err != nil {
+		return gcsError(err)
+	}
+
+	Log.Info("Created object", "object", obj.Id)
+
+	return nil
+
+}
+
+func (s *gcsObjectStore) Share(bucket, path, user string) error {
+
+	var ac storage.ObjectAccessControl
+	ac.Role = "READER"
+
+	_, err := s.svc.ObjectAccessControls.Update(bucket, path,
+		"user-"+user, &ac).Do()
+	return gcsError(err)
+
+}
+
+func (s *gcsObjectStore) Delete(bucket, path string) error {
+	return gcsError(s.svc.Objects.Delete(bucket, path).Do())
+}
+
+func (s *gcsObjectStore) List(bucket, prefix string) ([]string, error) {
+
+	var names []string
+	err := s.svc.Objects.List(bucket).Prefix(prefix).Pages(
+		context.Background(), func(objs *storage.Objects) error {
+			for _, o := range objs.Items {
+				names = append(names, o.Name)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, gcsError(err)
+	}
+
+	return names, nil
+
+}
+
+func (s *gcsObjectStore) ListPrefixes(bucket, prefix string) ([]string, error) {
+
+	var prefixes []string
+	err := s.svc.Objects.List(bucket).Prefix(prefix).Delimiter("/").Pages(
+		context.Background(), func(objs *storage.Objects) error {
+			prefixes = append(prefixes, objs.Prefixes...)
+			return nil
+		})
+	if err != nil {
+		return nil, gcsError(err)
+	}
+
+	return prefixes, nil
+
+}
@@ -0,0 +1,308 @@
+package main
+
+// Object store in a local directory, STORAGE_DIR.  Each bucket is a
+// directory, holding objects under objects/ and their generations under
+// generations/.  Writes to a bucket are serialised with a lock file, so that
+// generation checks hold between processes.
+//
+// There's no access control, sharing an object does nothing.
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type localObjectStore struct {
+	dir string
+}
+
+func newLocalObjectStore() (*localObjectStore, error) {
+
+	dir := Getenv("STORAGE_DIR", "")
+	if dir == "" {
+		return nil, errors.New("STORAGE_DIR not set")
+	}
+
+	return &localObjectStore{dir: dir}, nil
+
+}
+
+// Paths of an object and its generation file.  Bucket and object names
+// mustn't be able to point outside the directory.
+func (s *localObjectStore) paths(bucket, path string) (string, string, error) {
+
+	if bucket == "" || strings.Contains(bucket, "/") ||
+		strings.HasPrefix(bucket, ".") {
+		return "", "", errors.New("Bad bucket name: " + bucket)
+	}
+
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || p == "." || p == ".." {
+			return "", "", errors.New("Bad object name: " + path)
+		}
+	}
+
+	b := filepath.Join(s.dir, bucket)
+	return filepath.Join(b, "objects", filepath.FromSlash(path)),
+		filepath.Join(b, "generations", filepath.FromSlash(path)), nil
+
+}
+
+// Takes the bucket's lock, returns a function to release it.
+func (s *localObjectStore) lock(bucket string) (func(), error) {
+
+	dir := filepath.Join(s.dir, bucket)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+
+}
+
+func (s *localObjectStore) generation(genPath string) (int64, error) {
+
+	data, err := ioutil.ReadFile(genPath)
+	if os.IsNotExist(err) {
+		return 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+
+}
+
+func (s *localObjectStore) Generation(bucket, path string) (int64, error) {
+
+	_, genPath, err := s.paths(bucket, path)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.generation(genPath)
+
+}
+
+// The generation is read under the lock, so that it goes with the content.
+func (s *localObjectStore) Open(bucket, path string) (io.ReadCloser, int64, error) {
+
+	objPath, genPath, err := s.paths(bucket, path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	unlock, err := s.lock(bucket)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	generation, err := s.generation(genPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Writes replace the file, so this keeps reading what was there.
+	f, err := os.Open(objPath)
+	if os.IsNotExist(err) {
+		return nil, 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return f, generation, nil
+
+}
+
+// Content is written to a temporary file before taking the lock, then
+// renamed into place.  Generations are the time of writing, in nanoseconds,
+// so an object which is deleted and made again doesn't reuse a generation.
+func (s *localObjectStore) Put(bucket, path string, r io.Reader, generation int64, attrs *ObjectAttrs) error {
+
+	objPath, genPath, err := s.paths(bucket, path)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range []string{filepath.Dir(objPath), filepath.Dir(genPath)} {
+		err = os.MkdirAll(d, 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(objPath), ".upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(bucket)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := s.generation(genPath)
+	if err == ErrObjectNotFound {
+		current = 0
+	} else if err != nil {
+		return err
+	}
+
+	if generation >= 0 && generation != current {
+		return ErrPreconditionFailed
+	}
+
+	next := time.Now().UnixNano()
+	if next <= current {
+		next = current + 1
+	}
+
+	err = os.Rename(tmp.Name(), objPath)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(genPath, []byte(strconv.FormatInt(next, 10)),
+		0600)
+	if err != nil {
+		return err
+	}
+
+	Log.Info("Created object", "object", bucket+"/"+path,
+		"generation", next)
+
+	return nil
+
+}
+
+func (s *localObjectStore) Share(bucket, path, user string) error {
+	return nil
+}
+
+func (s *localObjectStore) Delete(bucket, path string) error {
+
+	objPath, genPath, err := s.paths(bucket, path)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(bucket)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(objPath)
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(genPath)
+
+}
+
+func (s *localObjectStore) List(bucket, prefix string) ([]string, error) {
+
+	if bucket == "" || strings.Contains(bucket, "/") ||
+		strings.HasPrefix(bucket, ".") {
+		return nil, errors.New("Bad bucket name: " + bucket)
+	}
+
+	root := filepath.Join(s.dir, bucket, "objects")
+
+	var names []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+
+}
+
+func (s *localObjectStore) ListPrefixes(bucket, prefix string) ([]string, error) {
+
+	names, err := s.List(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var prefixes []string
+	for _, name := range names {
+		i := strings.Index(name[len(prefix):], "/")
+		if i < 0 {
+			continue
+		}
+		p := name[:len(prefix)+i+1]
+		if !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	return prefixes, nil
+
+}
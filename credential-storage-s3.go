@@ -0,0 +1,424 @@
+package main
+
+// Object store in Amazon S3, or an S3-compatible store such as MinIO.
+//
+//   S3_ENDPOINT           e.g. https://s3.eu-west-2.amazonaws.com or
+//                         http://minio:9000
+//   S3_REGION             Default us-east-1
+//   S3_ACCESS_KEY_ID      Credentials, AWS_ACCESS_KEY_ID and
+//   S3_SECRET_ACCESS_KEY  AWS_SECRET_ACCESS_KEY are used if these aren't set
+//
+// Buckets are addressed by path.  S3 has no generation numbers, so they're
+// emulated: each write stores the object's generation in its metadata, and
+// is conditional on the ETag of the version whose generation was checked
+// (If-Match), or on there being no object (If-None-Match).  A write which
+// leaves the content unchanged keeps its ETag, so a concurrent write can
+// still succeed after it, but nothing is lost as nothing changed.
+//
+// Access is up to bucket policies, sharing an object does nothing.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata header holding the emulated generation.
+const s3GenerationHeader = "X-Amz-Meta-Generation"
+
+type s3ObjectStore struct {
+	endpoint *url.URL
+	region   string
+	keyID    string
+	secret   string
+	client   *http.Client
+}
+
+func newS3ObjectStore() (*s3ObjectStore, error) {
+
+	endpoint, err := url.Parse(Getenv("S3_ENDPOINT", ""))
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.New("S3_ENDPOINT not set, or not a URL")
+	}
+
+	keyID := Getenv("S3_ACCESS_KEY_ID", Getenv("AWS_ACCESS_KEY_ID", ""))
+	secret := Getenv("S3_SECRET_ACCESS_KEY",
+		Getenv("AWS_SECRET_ACCESS_KEY", ""))
+	if keyID == "" || secret == "" {
+		return nil, errors.New("S3 credentials not set")
+	}
+
+	return &s3ObjectStore{
+		endpoint: endpoint,
+		region:   Getenv("S3_REGION", "us-east-1"),
+		keyID:    keyID,
+		secret:   secret,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}, nil
+
+}
+
+// S3's URI encoding, everything but unreserved characters, and optionally /.
+func s3Escape(s string, slash bool) string {
+
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '.' ||
+			c == '_' || c == '~' || (slash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Makes a signed request (AWS Signature Version 4).  The body is hashed for
+// the signature, so it's passed as bytes.
+func (s *s3ObjectStore) request(method, bucket, path string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+
+	uri := "/" + s3Escape(bucket, false)
+	if path != "" {
+		uri += "/" + s3Escape(path, true)
+	}
+
+	// Query values sorted by key, encoded the S3 way.
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, false)+"="+
+				s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	rawQuery := strings.Join(params, "&")
+
+	u := *s.endpoint
+	u.Path = ""
+	u.RawPath = ""
+	target := u.String() + strings.TrimSuffix(s.endpoint.Path, "/") + uri
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Host and the x-amz- headers are signed.
+	signed := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") {
+			signed[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		method,
+		strings.TrimSuffix(s.endpoint.Path, "/") + uri,
+		rawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") +
+		"\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := s3HMAC([]byte("AWS4"+s.secret), date)
+	key = s3HMAC(key, s.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		s.keyID+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+
+	return s.client.Do(req)
+
+}
+
+// Turns an unsuccessful response into an error.
+func s3Error(resp *http.Response) error {
+
+	switch resp.StatusCode {
+	case 404:
+		return ErrObjectNotFound
+	// 409 is a conditional write racing another.
+	case 409, 412:
+		return ErrPreconditionFailed
+	}
+
+	data, _ := ioutil.ReadAll(resp.Body)
+
+	var e struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3 returned %d: %s: %s", resp.StatusCode,
+			e.Code, e.Message)
+	}
+
+	return fmt.Errorf("S3 returned %d", resp.StatusCode)
+
+}
+
+// Objects written elsewhere don't have a generation, they count as 1.
+func s3Generation(resp *http.Response) int64 {
+
+	generation, err := strconv.ParseInt(resp.Header.Get(s3GenerationHeader),
+		10, 64)
+	if err != nil || generation < 1 {
+		return 1
+	}
+
+	return generation
+
+}
+
+// Returns an object's generation and ETag.
+func (s *s3ObjectStore) head(bucket, path string) (int64, string, error) {
+
+	resp, err := s.request("HEAD", bucket, path, nil, nil, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, "", s3Error(resp)
+	}
+
+	return s3Generation(resp), resp.Header.Get("ETag"), nil
+
+}
+
+func (s *s3ObjectStore) Generation(bucket, path string) (int64, error) {
+	generation, _, err := s.head(bucket, path)
+	return generation, err
+}
+
+func (s *s3ObjectStore) Open(bucket, path string) (io.ReadCloser, int64, error) {
+
+	resp, err := s.request("GET", bucket, path, nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, 0, s3Error(resp)
+	}
+
+	return resp.Body, s3Generation(resp), nil
+
+}
+
+// Objects are read into memory to be signed, they're small apart from
+// streamed files.
+func (s *s3ObjectStore) Put(bucket, path string, r io.Reader, generation int64, attrs *ObjectAttrs) error {
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if attrs != nil && attrs.ContentType != "" {
+		header.Set("Content-Type", attrs.ContentType)
+	}
+	if attrs != nil && attrs.CacheControl != "" {
+		header.Set("Cache-Control", attrs.CacheControl)
+	}
+
+	var next int64
+	switch {
+
+	case generation == 0:
+		header.Set("If-None-Match", "*")
+		next = 1
+
+	case generation > 0:
+		current, etag, err := s.head(bucket, path)
+		if err == ErrObjectNotFound {
+			return ErrPreconditionFailed
+		}
+		if err != nil {
+			return err
+		}
+		if current != generation {
+			return ErrPreconditionFailed
+		}
+		header.Set("If-Match", etag)
+		next = current + 1
+
+	default:
+		current, _, err := s.head(bucket, path)
+		if err != nil && err != ErrObjectNotFound {
+			return err
+		}
+		next = current + 1
+
+	}
+
+	header.Set(s3GenerationHeader, strconv.FormatInt(next, 10))
+
+	resp, err := s.request("PUT", bucket, path, nil, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return s3Error(resp)
+	}
+
+	Log.Info("Created object", "object", bucket+"/"+path,
+		"generation", next)
+
+	return nil
+
+}
+
+func (s *s3ObjectStore) Share(bucket, path, user string) error {
+	return nil
+}
+
+// S3 doesn't say whether there was anything to delete.
+func (s *s3ObjectStore) Delete(bucket, path string) error {
+
+	resp, err := s.request("DELETE", bucket, path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		return s3Error(resp)
+	}
+
+	return nil
+
+}
+
+// Lists with ListObjectsV2, following continuation tokens.
+func (s *s3ObjectStore) list(bucket, prefix, delimiter string) ([]string, []string, error) {
+
+	var names, prefixes []string
+	token := ""
+
+	for {
+
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.request("GET", bucket, "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode != 200 {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			CommonPrefixes []struct {
+				Prefix string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, errors.New("Couldn't parse S3 listing: " +
+				err.Error())
+		}
+
+		for _, c := range result.Contents {
+			names = append(names, c.Key)
+		}
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+
+		if !result.IsTruncated {
+			return names, prefixes, nil
+		}
+		token = result.NextContinuationToken
+
+	}
+
+}
+
+func (s *s3ObjectStore) List(bucket, prefix string) ([]string, error) {
+	names, _, err := s.list(bucket, prefix, "")
+	return names, err
+}
+
+func (s *s3ObjectStore) ListPrefixes(bucket, prefix string) ([]string, error) {
+	_, prefixes, err := s.list(bucket, prefix, "/")
+	return prefixes, err
+}
@@ -0,0 +1,212 @@
+package main
+
+// Object stores, holding users' credentials, INDEX files and CRLs.
+//
+// STORAGE_BACKEND picks the store:
+//
+//   gcs    Google Cloud Storage, the default
+//   local  A directory, STORAGE_DIR, for testing and on-prem use
+//          (see credential-storage-local.go)
+//   s3     Amazon S3 or an S3-compatible store such as MinIO
+//          (see credential-storage-s3.go)
+//
+// Updates are guarded by generation numbers, as Cloud Storage does, and
+// stores which don't have them emulate them.  UpdateObject does a
+// read-modify-write with them, retrying if someone else gets there first,
+// until UPDATE_DEADLINE (default 32s) has passed.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+var (
+	// Returned when an object doesn't exist.
+	ErrObjectNotFound = errors.New("Object not found")
+
+	// Returned when a write's generation doesn't match the object's.
+	ErrPreconditionFailed = errors.New("Generation doesn't match")
+
+	// Returned by an UpdateObject mutation to leave the object as it is.
+	ErrUnchanged = errors.New("Object unchanged")
+)
+
+// Returned by UpdateObject when every attempt lost a race with another
+// writer, and the deadline has passed.
+type PreconditionError struct {
+	Bucket     string
+	Path       string
+	Generation int64
+	Attempts   int
+}
+
+func (e *PreconditionError) Error() string {
+	return fmt.Sprintf("%s/%s kept changing: gave up after %d attempts, "+
+		"last at generation %d", e.Bucket, e.Path, e.Attempts, e.Generation)
+}
+
+// Optional attributes of an object being written.
+type ObjectAttrs struct {
+	ContentType  string
+	CacheControl string
+}
+
+type ObjectStore interface {
+
+	// Returns an object's current generation.
+	Generation(bucket, path string) (int64, error)
+
+	// Opens an object for reading, and returns its generation.
+	Open(bucket, path string) (io.ReadCloser, int64, error)
+
+	// Writes an object.  If generation is 0, the object mustn't exist, if
+	// it's positive, it must be the object's current generation, if it's
+	// negative, the object is written regardless.  attrs may be nil.
+	Put(bucket, path string, r io.Reader, generation int64, attrs *ObjectAttrs) error
+
+	// Gives a user read access to an object.
+	Share(bucket, path, user string) error
+
+	// Deletes an object.
+	Delete(bucket, path string) error
+
+	// Lists the names of objects starting with prefix.
+	List(bucket, prefix string) ([]string, error)
+
+	// Lists the "directories" under prefix, i.e. the distinct names
+	// starting with prefix up to the next /, including the /.
+	ListPrefixes(bucket, prefix string) ([]string, error)
+}
+
+// Connects to the object store picked by STORAGE_BACKEND.  The key is the
+// service account's private key, used by Cloud Storage.
+func ObjectStoreSignin(key []byte) (ObjectStore, error) {
+
+	switch backend := Getenv("STORAGE_BACKEND", "gcs"); backend {
+	case "gcs":
+		svc, err := StorageSignin(key)
+		if err != nil {
+			return nil, err
+		}
+		return &gcsObjectStore{svc: svc}, nil
+	case "local":
+		return newLocalObjectStore()
+	case "s3":
+		return newS3ObjectStore()
+	default:
+		return nil, errors.New("Unknown STORAGE_BACKEND: " + backend)
+	}
+
+}
+
+// Changes an object's content.  data is the current content, nil if the
+// object doesn't exist, in which case exists is false.  Returns the new
+// content, or ErrUnchanged to leave the object alone.  It may be called more
+// than once, so shouldn't have side effects.
+type ObjectMutation func(data []byte, exists bool) ([]byte, error)
+
+// Backoff between attempts: doubling from updateBackoffBase, up to
+// updateBackoffMax, with random jitter so that writers don't collide again.
+// See https://cloud.google.com/storage/docs/exponential-backoff
+const (
+	updateBackoffBase = 250 * time.Millisecond
+	updateBackoffMax  = 8 * time.Second
+)
+
+func updateBackoff(attempt int) time.Duration {
+
+	wait := updateBackoffMax
+	if attempt < 6 {
+		wait = updateBackoffBase << uint(attempt)
+		if wait > updateBackoffMax {
+			wait = updateBackoffMax
+		}
+	}
+
+	// Half the wait, plus up to the other half at random.  Crypto random
+	// isn't needed for security, but unlike seeding on the time it won't
+	// be the same for writers started together.
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(wait/2)))
+	if err != nil {
+		return wait
+	}
+
+	return wait/2 + time.Duration(jitter.Int64())
+
+}
+
+// Read-modify-write of an object, made for a user, who's given read access.
+// The write is conditional on the generation read, or on the object not
+// existing, so that a concurrent change is never overwritten.  On losing a
+// race it reads again and retries, with backoff, until UPDATE_DEADLINE has
+// passed, then returns a *PreconditionError.
+func UpdateObject(store ObjectStore, user, bucket, path string, mutate ObjectMutation) error {
+
+	timeout, err := time.ParseDuration(Getenv("UPDATE_DEADLINE", "32s"))
+	if err != nil {
+		return errors.New("Bad UPDATE_DEADLINE: " + err.Error())
+	}
+	deadline := time.Now().Add(timeout)
+
+	for attempt := 0; ; attempt++ {
+
+		// Content and generation are read together.  Generation 0 means
+		// the object mustn't exist when it's written.
+		var data []byte
+		var generation int64
+		exists := true
+
+		r, g, err := store.Open(bucket, path)
+		if err == ErrObjectNotFound {
+			exists = false
+		} else if err != nil {
+			return err
+		} else {
+			data, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			if g <= 0 {
+				return errors.New("No generation for " + path)
+			}
+			generation = g
+		}
+
+		content, err := mutate(data, exists)
+		if err == ErrUnchanged {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = Upload(store, user, bucket, path, bytes.NewReader(content),
+			generation)
+		if err != ErrPreconditionFailed {
+			return err
+		}
+
+		wait := updateBackoff(attempt)
+		if time.Now().Add(wait).After(deadline) {
+			return &PreconditionError{
+				Bucket:     bucket,
+				Path:       path,
+				Generation: generation,
+				Attempts:   attempt + 1,
+			}
+		}
+
+		Log.Info("Object changed, retrying", "path", path,
+			"generation", generation, "wait", wait)
+		time.Sleep(wait)
+
+	}
+
+}
@@ -1,64 +1,409 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bufio"
+	"bytes"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func main() {
 
-	if len(os.Args) != 3 {
-		fmt.Println("Usage:")
-		fmt.Println("  decode <key> <input>")
+	fetchMode := flag.Bool("fetch", false,
+		"Fetch an object from storage and write out the original file")
+	out := flag.String("out", ".",
+		"With -fetch, directory to write to, or - for stdout")
+	flag.Parse()
+	args := flag.Args()
+
+	if *fetchMode {
+
+		if len(args) != 3 {
+			usage()
+		}
+
+		private, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			Log.Error("Couldn't read key file", "error", err)
+			os.Exit(1)
+		}
+
+		err = fetch(private, args[1], args[2], *out)
+		if err != nil {
+			Log.Error("Couldn't fetch object", "error", err)
+			os.Exit(1)
+		}
+
+		return
+
+	}
+
+	if len(args) != 2 && len(args) != 3 {
+		usage()
+	}
+
+	aeskey, err := readHexKey(args[0])
+	if err != nil {
+		Log.Error("Couldn't read key", "error", err)
 		os.Exit(1)
 	}
 
-	key, err := ioutil.ReadFile(os.Args[1])
+	f, err := os.Open(args[1])
 	if err != nil {
-		fmt.Printf("Couldn't open file.\n")
-		return
+		Log.Error("Couldn't open file", "error", err)
+		os.Exit(1)
 	}
+	defer f.Close()
 
-	aeskey := make([]byte, len(key)/2)
+	user := ""
+	if len(args) == 3 {
+		user = args[2]
+	}
 
-	_, err = hex.Decode(aeskey, key)
+	in, hdr, raw, err := openObject(f)
 	if err != nil {
-		fmt.Println("Hex decode: " + err.Error())
+		Log.Error("Couldn't parse envelope", "error", err)
+		os.Exit(1)
+	}
+
+	if hdr != nil && user == "" {
+		Log.Error("Object is in the envelope format, user must be given")
+		os.Exit(1)
+	}
+
+	if hdr == nil || hdr.Cipher != cipherAESGCMStream {
+		decodeItem(aeskey, user, io.MultiReader(bytes.NewReader(raw), in))
 		return
 	}
 
-	input, _ := ioutil.ReadFile(os.Args[2])
+	w := bufio.NewWriter(os.Stdout)
+	item, err := OpenStream(aeskey, user, hdr, raw, in, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		Log.Error("Couldn't decrypt", "error", err)
+		os.Exit(1)
+	}
+
+	Log.Info("Decoded stream", "name", item.Name,
+		"description", item.Description)
 
-	inputb := make([]byte, len(input)/2)
+}
+
+func usage() {
+	fmt.Println("Usage:")
+	fmt.Println("  decode <key> <input> [<user>]")
+	fmt.Println("  decode -fetch [-out <dir>] <private.json> <user> <object>")
+	fmt.Println("The user is needed for objects in the envelope format.")
+	fmt.Println("Streams are decoded to their original contents, " +
+		"other objects to the item JSON.")
+	fmt.Println("With -fetch, the object's key is unwrapped with Cloud KMS " +
+		"and the original file written, named after the item.")
+	os.Exit(1)
+}
 
-	_, err = hex.Decode(inputb, input)
+// Prepares an object for reading.  Objects are hex, except streams which are
+// binary.  Returns a reader for the object, and for envelopes, the header and
+// the bytes it was read from.  For legacy objects the header is nil.
+func openObject(r io.Reader) (io.Reader, *EnvelopeHeader, []byte, error) {
+
+	in := bufio.NewReader(r)
+	magic, _ := in.Peek(len(envelopeMagic))
+	if !IsEnvelope(magic) {
+		in = bufio.NewReader(hex.NewDecoder(in))
+		magic, _ = in.Peek(len(envelopeMagic))
+	}
+
+	if !IsEnvelope(magic) {
+		Log.Warn("Legacy object, can't check it hasn't been tampered with")
+		return in, nil, nil, nil
+	}
+
+	hdr, raw, err := ReadEnvelopeHeader(in)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return nil, nil, nil, err
 	}
 
-	block, err := aes.NewCipher(aeskey)
+	Log.Info("Envelope", "version", hdr.Version, "cipher", hdr.Cipher,
+		"name", hdr.Name, "kms_key_version", hdr.KMSKeyVersion)
+
+	return in, hdr, raw, nil
+
+}
+
+// Decrypts a whole object and prints the item JSON.
+func decodeItem(aeskey []byte, user string, r io.Reader) {
+
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		panic(err.Error())
+		Log.Error("Couldn't read object", "error", err)
+		os.Exit(1)
 	}
 
-	// IV is the counter.  This is just 138.
-	iv := make([]byte, 16)
-	for i := 0; i < 16; i++ {
-		iv[i] = 0
+	plaintext, err := OpenItem(aeskey, user, data)
+	if err != nil {
+		Log.Error("Couldn't decrypt", "error", err)
+		os.Exit(1)
 	}
-	iv[15] = 138
 
-	// Ciphertext is big as plaintext.
-	ciphertext := make([]byte, len(inputb))
+	fmt.Printf("%s\n", plaintext)
 
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(ciphertext, inputb)
+}
+
+// Fetches a user's object from storage, unwraps its key with Cloud KMS, and
+// writes out the original contents.
+func fetch(private []byte, user, object, out string) error {
+
+	ssvc, err := ObjectStoreSignin(private)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("%s\n", ciphertext)
+	km, err := KeyManagerSignin(private)
+	if err != nil {
+		return err
+	}
+
+	bucket := Getenv("BUCKET", "")
+
+	body, _, err := ssvc.Open(bucket, user+"/"+object)
+	if err != nil {
+		return errors.New("Couldn't get object: " + err.Error())
+	}
+	defer body.Close()
+
+	in, hdr, raw, err := openObject(body)
+	if err != nil {
+		return err
+	}
+
+	// Envelopes say where their wrapped key is kept.
+	indexName := "INDEX"
+	if hdr != nil && hdr.WrappedKey != nil {
+		indexName = hdr.WrappedKey.Object
+	}
+
+	var indexData bytes.Buffer
+	err = Download(ssvc, bucket, user+"/"+indexName, &indexData)
+	if err != nil {
+		return err
+	}
+
+	index, err := ParseIndex(indexData.Bytes())
+	if err != nil {
+		return err
+	}
+
+	err = checkItemName(index, object, hdr)
+	if err != nil {
+		return err
+	}
+
+	wrapped, err := findWrappedKey(index, object, hdr)
+	if err != nil {
+		return err
+	}
+
+	// Envelopes say which key wrapped theirs, otherwise it's the user's.
+	var kmsKey string
+	if hdr != nil && hdr.KMSKey != "" {
+		kmsKey = hdr.KMSKey
+	} else {
+		kmsKey, err = ResolveKeyName(ssvc, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	aeskey, err := unwrapKey(km, kmsKey, wrapped)
+	if err != nil {
+		return err
+	}
+
+	// Streams are decrypted to a temporary file, so that nothing is
+	// written out until the whole stream is authenticated.
+	if hdr != nil && hdr.Cipher == cipherAESGCMStream {
+
+		tmp, err := ioutil.TempFile("", "decode")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		item, err := OpenStream(aeskey, user, hdr, raw, in, tmp)
+		if err != nil {
+			return err
+		}
+
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		return writeContent(out, item, tmp)
+
+	}
+
+	data, err := ioutil.ReadAll(io.MultiReader(bytes.NewReader(raw), in))
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := OpenItem(aeskey, user, data)
+	if err != nil {
+		return err
+	}
+
+	var item Item
+	err = json.Unmarshal(plaintext, &item)
+	if err != nil {
+		return errors.New("Couldn't parse item: " + err.Error())
+	}
+
+	content, err := base64.StdEncoding.DecodeString(item.Content)
+	if err != nil {
+		return errors.New("Couldn't decode content: " + err.Error())
+	}
+
+	return writeContent(out, &item, bytes.NewReader(content))
+
+}
+
+// Finds the wrapped key for an object in the INDEX.  Envelopes identify the
+// key by its hash.  Legacy objects, and envelopes whose key has been
+// re-wrapped by rotate-ckms, are found by the INDEX entry naming them.
+func findWrappedKey(index *Index, object string, hdr *EnvelopeHeader) (string, error) {
+
+	if hdr != nil && hdr.WrappedKey != nil {
+		key, ok := findKeyByHash(index, hdr.WrappedKey)
+		if ok {
+			return key, nil
+		}
+	}
+
+	for _, entry := range index.Entries {
+		for _, o := range entry.Objects() {
+			if o == object {
+				return entry.WrappedKey(), nil
+			}
+		}
+	}
+
+	return "", errors.New("No INDEX entry for " + object)
+
+}
+
+// The item name in an envelope is authenticated, but isn't always the name
+// of the object holding it: scripts name items after their working files.
+// Where it is the name of one of the user's objects, it must be this one,
+// otherwise objects sharing a key, a device's US and UK configurations say,
+// could be swapped without decryption failing.
+func checkItemName(index *Index, object string, hdr *EnvelopeHeader) error {
+
+	if hdr == nil || hdr.Name == object {
+		return nil
+	}
+
+	for _, o := range index.Objects() {
+		if o == hdr.Name {
+			return errors.New(object + " holds " + hdr.Name +
+				", object has been tampered with")
+		}
+	}
+
+	return nil
+
+}
+
+// Finds a wrapped key in the INDEX by its hash.
+func findKeyByHash(index *Index, ref *WrappedKeyRef) (string, bool) {
+
+	for _, entry := range index.Entries {
+
+		key := entry.WrappedKey()
+		if NewWrappedKeyRef(ref.Object, []byte(key)).SHA256 == ref.SHA256 {
+			return key, true
+		}
+
+	}
+
+	return "", false
+
+}
+
+// Unwraps a hex-encoded key, as written by encode-key.
+func unwrapKey(km KeyManager, kmsKey, wrapped string) ([]byte, error) {
+
+	ciphertext, err := hex.DecodeString(strings.TrimSpace(wrapped))
+	if err != nil {
+		return nil, errors.New("Couldn't decode wrapped key: " +
+			err.Error())
+	}
+
+	key, err := km.Decrypt(kmsKey, ciphertext)
+	if err != nil {
+		return nil, errors.New("Couldn't unwrap key: " + err.Error())
+	}
+
+	return key, nil
+
+}
+
+// Writes decoded content to a file in the out directory, named after the
+// item, or to stdout if out is "-".  Secrets aren't echoed to a terminal.
+func writeContent(out string, item *Item, content io.Reader) error {
+
+	if out == "-" {
+		if item.Secret && isTerminal(os.Stdout) {
+			return errors.New(item.Name + " is a secret, not echoing " +
+				"it to the terminal, use -out")
+		}
+		_, err := io.Copy(os.Stdout, content)
+		return err
+	}
+
+	// The name is authenticated, but still shouldn't pick the directory.
+	path := filepath.Join(out, filepath.Base(item.Name))
+
+	tmp, err := ioutil.TempFile(out, ".decode")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, content)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	Log.Info("Wrote file", "path", path, "description", item.Description,
+		"secret", item.Secret)
+	return nil
+
+}
 
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
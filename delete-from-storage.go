@@ -4,17 +4,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-
-	"google.golang.org/api/storage/v1"
 	//	"bytes"
 )
 
-func delete(svc *storage.Service, user, bucket, path string) error {
+func delete(svc ObjectStore, user, bucket, path string) error {
 
-	err := svc.Objects.Delete(bucket, path).Do()
+	err := svc.Delete(bucket, path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't Delete object: %s\n",
-			err.Error())
+		Log.Error("Couldn't Delete object", "error", err)
 		return err
 	}
 
@@ -37,8 +34,7 @@ func main() {
 	// Read the key file
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't read key file: %s\n",
-			err.Error())
+		Log.Error("Couldn't read key file", "error", err)
 		return
 	}
 
@@ -46,22 +42,20 @@ func main() {
 
 	filename := os.Args[3]
 
-	svc, err := StorageSignin(key)
+	svc, err := ObjectStoreSignin(key)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't connect: %s\n",
-			err.Error())
+		Log.Error("Couldn't connect", "error", err)
 		return
 	}
 
-	fmt.Fprintf(os.Stderr, "Connected.\n")
+	Log.Info("Connected")
 
 	bucket := Getenv("BUCKET", "")
 	path := user + "/" + filename
 
 	err = delete(svc, user, bucket, path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't delete: %s\n",
-			err.Error())
+		Log.Error("Couldn't delete", "error", err)
 		return
 	}
 
@@ -1,64 +1,274 @@
 package main
 
+// Offboards a user: lists what they have, revokes their certificates,
+// deletes everything in their area of the bucket, and schedules their key
+// for destruction.  A record of what was destroyed is written, signed with
+// the service account's key.
+
 import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
 
-	"google.golang.org/api/cloudkms/v1"
+	"golang.org/x/oauth2/google"
 )
 
-func destroyKms(svc *cloudkms.Service, user string) error {
+// What was done to offboard a user.
+type auditRecord struct {
+	Action   string                   `json:"action"`
+	User     string                   `json:"user"`
+	Time     string                   `json:"time"`
+	Operator string                   `json:"operator"`
+	Index    []map[string]interface{} `json:"index"`
+	Revoked  bool                     `json:"certificates_revoked"`
+	Objects  []string                 `json:"objects_deleted"`
+	KMSKey   string                   `json:"kms_key"`
+	Versions []*ScheduledDestruction  `json:"key_versions_destroyed"`
+	Error    string                   `json:"error,omitempty"`
+}
 
-	// Get environment variables.
-	projectID := Getenv("PROJECT_ID", "")
-	keyRing := Getenv("KEY_RING", "")
+// An audit record and its signature.  The signature is over the record's
+// bytes exactly as they appear.
+type signedAuditRecord struct {
+	Record    json.RawMessage `json:"record"`
+	Signature auditSignature  `json:"signature"`
+}
 
-	cryptoKey := KeyID(user)
+type auditSignature struct {
+	Algorithm string `json:"algorithm"`
+	Signer    string `json:"signer"`
+	KeyID     string `json:"key_id"`
+	Value     string `json:"value"`
+}
 
-	template := "projects/%s/locations/%s/keyRings/%s"
-	resourceName := fmt.Sprintf(template, projectID, "global", keyRing)
+// Signs with a service account's private key.  The signature can be checked
+// with the certificate Google publishes for the key ID.
+type auditSigner struct {
+	email string
+	keyID string
+	key   *rsa.PrivateKey
+}
+
+func newAuditSigner(private []byte) (*auditSigner, error) {
 
-	fmt.Printf("Check for keyring %s...\n", keyRing)
-	_, err := svc.Projects.Locations.KeyRings.
-		Get(resourceName).Do()
+	conf, err := google.JWTConfigFromJSON(private)
 	if err != nil {
-		fmt.Printf("KeyRing get failed: %s\n",
+		return nil, err
+	}
+
+	block, _ := pem.Decode(conf.PrivateKey)
+	if block == nil {
+		return nil, errors.New("No private key in key file")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("Couldn't parse private key: " +
 			err.Error())
-		fmt.Printf("Maybe key ring %s does not exist.\n", keyRing)
-		return err
 	}
 
-	fmt.Println("Key ring exists.")
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Private key isn't RSA")
+	}
+
+	return &auditSigner{
+		email: conf.Email,
+		keyID: conf.PrivateKeyID,
+		key:   rsaKey,
+	}, nil
+
+}
+
+func (s *auditSigner) sign(rec *auditRecord) ([]byte, error) {
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256,
+		hash[:])
+	if err != nil {
+		return nil, err
+	}
 
-	template = "projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s"
-	resourceName = fmt.Sprintf(template, projectID, "global", keyRing,
-		cryptoKey)
+	// Not indented, that would change the record's bytes.
+	return json.Marshal(&signedAuditRecord{
+		Record: data,
+		Signature: auditSignature{
+			Algorithm: "RS256",
+			Signer:    s.email,
+			KeyID:     s.keyID,
+			Value:     base64.StdEncoding.EncodeToString(sig),
+		},
+	})
+
+}
 
-	fmt.Println("List crpyto key...")
-	res, err := svc.Projects.Locations.KeyRings.CryptoKeys.
-		CryptoKeyVersions.
-		List(resourceName).Do()
+// Reads the user's INDEX entries.  Wrapped keys are left out, they're of no
+// use to anyone once the user's key is destroyed.
+func readIndex(svc ObjectStore, user string) ([]map[string]interface{}, error) {
+
+	bucket := Getenv("BUCKET", "")
+
+	r, _, err := svc.Open(bucket, user+"/INDEX")
+	if err == ErrObjectNotFound {
+		return nil, nil
+	}
 	if err != nil {
-		fmt.Printf("CryptoKey create failed: %s\n",
-			err.Error())
-		return err
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, v := range res.CryptoKeyVersions {
+	index, err := ParseIndex(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []map[string]interface{}
+	for _, e := range index.Entries {
+		fields, err := IndexEntryFields(e)
+		if err != nil {
+			return nil, err
+		}
+		entry := map[string]interface{}{}
+		for k, v := range fields {
+			if k != "key" {
+				entry[k] = v
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+
+}
+
+// Lists the objects in the user's area of the bucket.
+func listObjects(svc ObjectStore, user string) ([]string, error) {
+
+	return svc.List(Getenv("BUCKET", ""), user+"/")
+
+}
+
+func printPlan(user string, rec *auditRecord, objects, versions []string) {
+
+	fmt.Printf("User: %s\n", user)
+
+	fmt.Printf("INDEX entries: %d\n", len(rec.Index))
+	for _, entry := range rec.Index {
+		fields := make([]string, 0, len(entry))
+		for k, v := range entry {
+			fields = append(fields, fmt.Sprintf("%s=%v", k, v))
+		}
+		sort.Strings(fields)
+		fmt.Printf("  %s\n", strings.Join(fields, " "))
+	}
+
+	fmt.Printf("Objects to delete: %d\n", len(objects))
+	for _, o := range objects {
+		fmt.Printf("  %s\n", o)
+	}
+
+	fmt.Printf("Key: %s\n", rec.KMSKey)
+	fmt.Printf("Key versions to destroy: %d\n", len(versions))
+	for _, v := range versions {
+		fmt.Printf("  %s\n", v)
+	}
+
+}
+
+// Asks the operator to confirm by typing the user's email.
+func confirm(user string) bool {
+
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		Log.Error("Not a terminal, use -yes to offboard without " +
+			"confirmation")
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "Type %s to confirm: ", user)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	return strings.TrimSpace(line) == user
+
+}
+
+// Revokes certificates, deletes objects and destroys the key, recording
+// what's done as it goes.  Stops at the first failure, so that nothing is
+// deleted if revocation fails.  revoke-all-key fails if any of the user's
+// certificates is still live afterwards.
+func offboard(km KeyManager, svc ObjectStore, user string, objects []string, rec *auditRecord) error {
 
-		fmt.Println("Delete " + v.Name + "...")
+	Log.Info("Revoke certificates...")
+	cmd := exec.Command("./revoke-all-key", user)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return errors.New("Couldn't revoke certificates: " + err.Error())
+	}
+	rec.Revoked = true
 
-		_, err := svc.Projects.Locations.KeyRings.CryptoKeys.
-			CryptoKeyVersions.
-			Destroy(v.Name,
-				&cloudkms.DestroyCryptoKeyVersionRequest{}).Do()
+	// Revocation deletes some objects itself.  The key record goes last,
+	// once the key is destroyed, so a failed run can be retried.
+	bucket := Getenv("BUCKET", "")
+	record := user + "/" + keyRecordObject
+	deleteObject := func(o string) error {
+		Log.Info("Delete object...", "object", o)
+		err := svc.Delete(bucket, o)
+		if err == ErrObjectNotFound {
+			return nil
+		}
 		if err != nil {
-			fmt.Printf("CryptoKey Destroy failed: %s\n",
+			return errors.New("Couldn't delete " + o + ": " +
 				err.Error())
-		} else {
-			fmt.Println("Success.")
 		}
+		rec.Objects = append(rec.Objects, o)
+		return nil
+	}
+
+	for _, o := range objects {
+		if o == record {
+			continue
+		}
+		err := deleteObject(o)
+		if err != nil {
+			return err
+		}
+	}
+
+	rec.Versions, err = km.Destroy(rec.KMSKey)
+	if err != nil {
+		return errors.New("Couldn't destroy key: " + err.Error())
+	}
+
+	err = deleteObject(record)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -67,32 +277,130 @@ func destroyKms(svc *cloudkms.Service, user string) error {
 
 func main() {
 
-	if len(os.Args) != 3 {
+	dryRun := flag.Bool("dry-run", false,
+		"Show what would be destroyed, and stop")
+	yes := flag.Bool("yes", false, "Don't ask for confirmation")
+	auditFile := flag.String("audit", "",
+		"File to write the audit record to, "+
+			"default offboard-<key id>-<time>.json")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) != 2 || args[1] == "" || strings.Contains(args[1], "/") {
 		fmt.Println("Usage:")
-		fmt.Println("  destroy-ckms <key> <user>")
+		fmt.Println("  destroy-ckms [-dry-run] [-yes] [-audit <file>] " +
+			"<key> <user>")
+		fmt.Println("Revokes the user's certificates, deletes their " +
+			"objects and schedules their key for destruction.")
 		os.Exit(1)
 	}
 
 	// Get environment variables.
-	keyfile := os.Args[1]
+	keyfile := args[0]
 
 	// Read the key file
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		fmt.Printf("Couldn't read key file: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
 	}
 
-	user := os.Args[2]
+	user := args[1]
 
-	svc, err := CloudKMSSignin(key)
+	// Fail now if we couldn't sign the record later.
+	signer, err := newAuditSigner(key)
 	if err != nil {
-		fmt.Printf("Couldn't connect: %s\n",
-			err.Error())
+		Log.Error("Couldn't load signing key", "error", err)
+		os.Exit(1)
+	}
+
+	km, err := KeyManagerSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
+
+	ssvc, err := ObjectStoreSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
+
+	now := time.Now().UTC()
+	rec := &auditRecord{
+		Action:   "offboard",
+		User:     user,
+		Time:     now.Format(time.RFC3339),
+		Operator: signer.email,
+	}
+
+	// The key record is in the user's area, find the key before it's
+	// deleted.
+	rec.KMSKey, err = ResolveKeyName(ssvc, user)
+	if err != nil {
+		Log.Error("Couldn't find key", "error", err)
+		os.Exit(1)
+	}
+
+	rec.Index, err = readIndex(ssvc, user)
+	if err != nil {
+		Log.Error("Couldn't read INDEX", "error", err)
+		os.Exit(1)
+	}
+
+	objects, err := listObjects(ssvc, user)
+	if err != nil {
+		Log.Error("Couldn't list objects", "error", err)
+		os.Exit(1)
+	}
+
+	versions, err := km.Versions(rec.KMSKey)
+	if err != nil {
+		Log.Error("Couldn't list key versions", "error", err)
+		os.Exit(1)
+	}
+
+	printPlan(user, rec, objects, versions)
+
+	if *dryRun {
+		Log.Info("Dry run, nothing destroyed")
 		return
 	}
 
-	destroyKms(svc, user)
+	if !*yes && !confirm(user) {
+		Log.Error("Not confirmed, nothing destroyed")
+		os.Exit(1)
+	}
+
+	err = offboard(km, ssvc, user, objects, rec)
+	if err != nil {
+		Log.Error("Offboarding failed", "error", err)
+		rec.Error = err.Error()
+	}
+
+	// The record is written whatever happened, it says how far we got.
+	path := *auditFile
+	if path == "" {
+		path = fmt.Sprintf("offboard-%s-%s.json", KeyID(user)[:16],
+			now.Format("20060102T150405Z"))
+	}
+
+	signed, serr := signer.sign(rec)
+	if serr == nil {
+		serr = ioutil.WriteFile(path, append(signed, '\n'), 0600)
+	}
+	if serr != nil {
+		Log.Error("Couldn't write audit record", "error", serr)
+		Log.Info("Audit record", "record", rec)
+		os.Exit(1)
+	}
+
+	Log.Info("Wrote audit record", "path", path)
+
+	if err != nil {
+		os.Exit(1)
+	}
+
+	Log.Info("Success")
 
 }
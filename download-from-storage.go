@@ -22,8 +22,7 @@ func main() {
 	// Read the key file
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't read key file: %s\n",
-			err.Error())
+		Log.Error("Couldn't read key file", "error", err)
 		return
 	}
 
@@ -31,22 +30,20 @@ func main() {
 
 	filename := os.Args[3]
 
-	svc, err := StorageSignin(key)
+	svc, err := ObjectStoreSignin(key)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't connect: %s\n",
-			err.Error())
+		Log.Error("Couldn't connect", "error", err)
 		return
 	}
 
-	fmt.Fprintf(os.Stderr, "Connected.\n")
+	Log.Info("Connected")
 
 	bucket := Getenv("BUCKET", "")
 	path := user + "/" + filename
 
 	err = Download(svc, bucket, path, os.Stdout)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't download: %s\n",
-			err.Error())
+		Log.Error("Couldn't download", "error", err)
 		return
 	}
 
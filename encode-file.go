@@ -1,86 +1,94 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bufio"
 	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
-type Item struct {
-	Name        string `json:"name,omitempty"`
-	Description string `json:"description,omitempty"`
-	Content     string `json:"content,omitempty"`
-	Secret      bool   `json:"secret,omitempty"`
-}
-
 func main() {
 
-	if len(os.Args) != 4 {
+	stream := flag.Bool("stream", false,
+		"Encrypt in chunks, writing binary output, for large files")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) != 4 && len(args) != 5 {
 		fmt.Println("Usage:")
-		fmt.Println("  encode-file <key> <input> <desc>")
+		fmt.Println("  encode-file [-stream] <key> <user> <input> <desc> " +
+			"[<keyinfo>]")
+		fmt.Println("keyinfo is the file written by encode-key, recorded in " +
+			"the envelope header.")
 		os.Exit(1)
 	}
 
-	key, err := ioutil.ReadFile(os.Args[1])
+	aeskey, err := readHexKey(args[0])
 	if err != nil {
-		fmt.Printf("Couldn't open file.\n")
-		return
+		Log.Error("Couldn't read key", "error", err)
+		os.Exit(1)
 	}
 
-	aeskey := make([]byte, len(key)/2)
-
-	_, err = hex.Decode(aeskey, key)
-	if err != nil {
-		fmt.Println("Hex decode: " + err.Error())
-		return
-	}
+	user := args[1]
+	desc := args[3]
 
-	input, err := ioutil.ReadFile(os.Args[2])
-	if err != nil {
-		fmt.Printf("Couldn't open file.\n")
-		return
+	var info *KeyInfo
+	if len(args) == 5 {
+		info, err = ReadKeyInfo(args[4])
+		if err != nil {
+			Log.Error("Couldn't read key info", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	desc := os.Args[3]
-
-	encoded := base64.StdEncoding.EncodeToString(input)
-
+	// Scripts encode from scratch directories, the name recorded is just
+	// the filename.
 	item := &Item{
-		Name:        os.Args[2],
+		Name:        filepath.Base(args[2]),
 		Description: desc,
-		Content:     encoded,
 		Secret:      false,
 	}
 
-	b, err := json.Marshal(&item)
-	if err != nil {
-		panic(err.Error())
-	}
+	if *stream {
+
+		input, err := os.Open(args[2])
+		if err != nil {
+			Log.Error("Couldn't open file", "error", err)
+			os.Exit(1)
+		}
+		defer input.Close()
+
+		out := bufio.NewWriter(os.Stdout)
+		err = SealStream(out, aeskey, user, item, info, input)
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			Log.Error("Couldn't encrypt", "error", err)
+			os.Exit(1)
+		}
+
+		return
 
-	block, err := aes.NewCipher(aeskey)
-	if err != nil {
-		panic(err.Error())
 	}
 
-	// IV is the counter.  This is just 138.
-	iv := make([]byte, 16)
-	for i := 0; i < 16; i++ {
-		iv[i] = 0
+	input, err := ioutil.ReadFile(args[2])
+	if err != nil {
+		Log.Error("Couldn't open file", "error", err)
+		os.Exit(1)
 	}
-	iv[15] = 138
 
-	// Ciphertext is big as plaintext.
-	ciphertext := make([]byte, len(b))
+	item.Content = base64.StdEncoding.EncodeToString(input)
 
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(ciphertext, b)
+	envelope, err := SealItem(aeskey, user, item, info)
+	if err != nil {
+		Log.Error("Couldn't encrypt", "error", err)
+		os.Exit(1)
+	}
 
-	h := fmt.Sprintf("%x", ciphertext)
-	fmt.Printf("%s", h)
+	fmt.Printf("%x", envelope)
 
 }
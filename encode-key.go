@@ -1,53 +1,68 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-
-	"google.golang.org/api/cloudkms/v1"
 )
 
-func encrypt(svc *cloudkms.Service, user string, data []byte) error {
-
-	// Get environment variables.
-	projectID := Getenv("PROJECT_ID", "")
-	keyRing := Getenv("KEY_RING", "")
-
-	cryptoKey := KeyID(user)
+// Wraps the key with the user's KMS key and writes it to stdout.  If infoFile
+// isn't empty, a description of the wrapping is written there, for the
+// envelope header.
+func encrypt(km KeyManager, ssvc ObjectStore, user string, data []byte, infoFile string) error {
 
-	template := "projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s"
-	resourceName := fmt.Sprintf(template, projectID, "global", keyRing,
-		cryptoKey)
+	resourceName, err := ResolveKeyName(ssvc, user)
+	if err != nil {
+		Log.Error("Couldn't find key", "error", err)
+		return err
+	}
 
-	fmt.Fprintf(os.Stderr, "Create crpyto key...\n")
-	resp, err := svc.Projects.Locations.KeyRings.CryptoKeys.
-		Encrypt(resourceName, &cloudkms.EncryptRequest{
-			Plaintext: base64.StdEncoding.EncodeToString(data),
-		}).Do()
+	Log.Info("Encrypt key...", "key", resourceName)
+	ciphertext, version, err := km.Encrypt(resourceName, data)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Encrypt failed: %s\n", err.Error())
-		return nil
+		Log.Error("Encrypt failed", "error", err)
+		return err
 	}
 
-	fmt.Fprintln(os.Stderr, "Success.")
+	Log.Info("Success", "version", version)
 
-	_ = resp
+	wrapped := hex.EncodeToString(ciphertext)
 
-	data, _ = base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if infoFile != "" {
+
+		// The wrapped key ends up in the INDEX "key" field.
+		info := &KeyInfo{
+			KMSKey:        resourceName,
+			KMSKeyVersion: version,
+			WrappedKey:    NewWrappedKeyRef("INDEX", []byte(wrapped)),
+		}
+
+		j, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(infoFile, j, 0600)
+		if err != nil {
+			Log.Error("Couldn't write key info", "error", err)
+			return err
+		}
+
+	}
 
-	fmt.Printf("%x", data)
+	fmt.Print(wrapped)
 	return nil
 
 }
 
 func main() {
 
-	if len(os.Args) != 4 {
+	if len(os.Args) != 4 && len(os.Args) != 5 {
 		fmt.Println("Usage:")
-		fmt.Println("  encode-key <key> <user> <fkey>")
+		fmt.Println("  encode-key <key> <user> <fkey> [<keyinfo>]")
+		fmt.Println("keyinfo is written with a description of the wrapping.")
 		os.Exit(1)
 	}
 
@@ -57,37 +72,38 @@ func main() {
 	// Read the key file
 	private, err := ioutil.ReadFile(privatejson)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't read key file: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
 	}
 
 	user := os.Args[2]
 
-	// Read the key file
-	key, err := ioutil.ReadFile(os.Args[3])
+	aeskey, err := readHexKey(os.Args[3])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't read key file: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't read key", "error", err)
+		os.Exit(1)
 	}
 
-	aeskey := make([]byte, len(key)/2)
-
-	_, err = hex.Decode(aeskey, key)
+	km, err := KeyManagerSignin(private)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't decode hex\n",
-			err.Error())
-		return
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
 	}
 
-	svc, err := CloudKMSSignin(private)
+	ssvc, err := ObjectStoreSignin(private)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't connect: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
 	}
 
-	encrypt(svc, user, aeskey)
+	infoFile := ""
+	if len(os.Args) == 5 {
+		infoFile = os.Args[4]
+	}
+
+	err = encrypt(km, ssvc, user, aeskey, infoFile)
+	if err != nil {
+		os.Exit(1)
+	}
 
 }
@@ -1,48 +1,32 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 )
 
-type Item struct {
-	Name        string `json:"name,omitempty"`
-	Description string `json:"description,omitempty"`
-	Content     string `json:"content,omitempty"`
-	Secret      bool   `json:"secret,omitempty"`
-}
-
 func main() {
 
-	if len(os.Args) != 5 {
+	if len(os.Args) != 6 && len(os.Args) != 7 {
 		fmt.Println("Usage:")
-		fmt.Println("  encode-secret <key> <name> <input> <desc>")
+		fmt.Println("  encode-secret <key> <user> <name> <input> <desc> " +
+			"[<keyinfo>]")
+		fmt.Println("keyinfo is the file written by encode-key, recorded in " +
+			"the envelope header.")
 		os.Exit(1)
 	}
 
-	key, err := ioutil.ReadFile(os.Args[1])
+	aeskey, err := readHexKey(os.Args[1])
 	if err != nil {
-		fmt.Printf("Couldn't open file.\n")
-		return
-	}
-
-	aeskey := make([]byte, len(key)/2)
-
-	_, err = hex.Decode(aeskey, key)
-	if err != nil {
-		fmt.Println("Hex decode: " + err.Error())
-		return
+		Log.Error("Couldn't read key", "error", err)
+		os.Exit(1)
 	}
 
-	name := os.Args[2]
-	input := os.Args[3]
-	desc := os.Args[4]
+	user := os.Args[2]
+	name := os.Args[3]
+	input := os.Args[4]
+	desc := os.Args[5]
 
 	encoded := base64.StdEncoding.EncodeToString([]byte(input))
 
@@ -53,30 +37,21 @@ func main() {
 		Secret:      true,
 	}
 
-	b, err := json.Marshal(&item)
-	if err != nil {
-		panic(err.Error())
+	var info *KeyInfo
+	if len(os.Args) == 7 {
+		info, err = ReadKeyInfo(os.Args[6])
+		if err != nil {
+			Log.Error("Couldn't read key info", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	block, err := aes.NewCipher(aeskey)
+	envelope, err := SealItem(aeskey, user, item, info)
 	if err != nil {
-		panic(err.Error())
-	}
-
-	// IV is the counter.  This is just 138.
-	iv := make([]byte, 16)
-	for i := 0; i < 16; i++ {
-		iv[i] = 0
+		Log.Error("Couldn't encrypt", "error", err)
+		os.Exit(1)
 	}
-	iv[15] = 138
-
-	// Ciphertext is big as plaintext.
-	ciphertext := make([]byte, len(b))
-
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(ciphertext, b)
 
-	h := fmt.Sprintf("%x", ciphertext)
-	fmt.Printf("%s", h)
+	fmt.Printf("%x", envelope)
 
 }
@@ -0,0 +1,715 @@
+package main
+
+// Checks that users' INDEX files, the objects in the bucket and the CAs
+// agree, and optionally repairs what it can.  The create and revoke scripts
+// update them in separate steps, so a failure part way through leaves them
+// out of step.
+//
+// The CAs are the directories in VPN_CA (VPN and VPN service certificates),
+// WEB_CA and PROBE_CA.  A CA directory holds live certificates as
+// cert.<serial>, revoked ones in revoked/, a register of certificates
+// issued, and a revoke_register from which the CRL is made.  CAs whose
+// variable isn't set aren't checked.
+//
+// Problems found, and what -repair does about them:
+//
+//   orphaned object         An object no INDEX entry names.  Deleted,
+//                           unless the INDEX has entries which can't be
+//                           read, which might name it.
+//   bad entry               An entry which is incomplete, or can't be
+//                           decoded as its type.  Reported only.
+//   missing objects         An entry naming objects which don't exist.  The
+//                           entry is removed, with its remaining objects.
+//   revoked certificate     An entry whose certificate has been revoked.
+//                           The entry is removed, with its objects, if the
+//                           certificate's end date is the entry's.  A
+//                           revoked certificate which only shares the
+//                           entry's name is reported only.
+//   no certificate          An entry with no certificate in its CA.
+//                           Reported only.
+//   no INDEX entry          A live certificate the user has no entry for.
+//                           Reported only, revoke it or issue it again.
+//   revoked but live        A certificate in revoke_register which is still
+//                           with the live ones.  Moved to revoked/.
+//   not in revoke_register  A certificate in revoked/ which isn't in the
+//                           CRL.  Reported only.
+//   not in register         A live certificate which wasn't registered.
+//                           Reported only.
+//
+// Objects are written before the INDEX entry naming them, so a credential
+// being created looks like orphaned objects.  Don't repair while the
+// provisioner is running.
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CA directories, by environment variable, and the entry types whose
+// certificates they sign.
+var fsckCAs = []struct {
+	env   string
+	types []string
+}{
+	{"VPN_CA", []string{IndexVPN, IndexVPNService}},
+	{"WEB_CA", []string{IndexWeb}},
+	{"PROBE_CA", []string{IndexProbe}},
+}
+
+// OID of the emailAddress subject attribute.
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// A certificate in a CA directory.
+type caCert struct {
+	serial   string
+	email    string
+	cn       string
+	notAfter time.Time
+	path     string
+}
+
+// What's in a CA directory.
+type caState struct {
+	env            string
+	dir            string
+	types          []string
+	live           []*caCert
+	revoked        []*caCert
+	register       map[string]bool
+	revokeRegister map[string]bool
+}
+
+// A problem found, and whether -repair deals with it.
+type problem struct {
+	user       string
+	kind       string
+	detail     string
+	repairable bool
+}
+
+// A repair, dealing with one or more problems.
+type repair struct {
+	user  string
+	apply func() error
+}
+
+// Serials are compared as openssl prints them, in upper case.
+func normaliseSerial(s string) string {
+	return strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(s,
+		"serial=")))
+}
+
+// Reads the cert.<serial> files in a directory.
+func readCerts(dir string) ([]*caCert, error) {
+
+	files, err := filepath.Glob(filepath.Join(dir, "cert.*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*caCert
+	for _, f := range files {
+
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			Log.Warn("Not a certificate", "file", f)
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			Log.Warn("Couldn't parse certificate", "file", f,
+				"error", err)
+			continue
+		}
+
+		c := &caCert{
+			serial:   normaliseSerial(strings.TrimPrefix(filepath.Base(f), "cert.")),
+			cn:       cert.Subject.CommonName,
+			notAfter: cert.NotAfter,
+			path:     f,
+		}
+
+		if len(cert.EmailAddresses) > 0 {
+			c.email = cert.EmailAddresses[0]
+		}
+		for _, n := range cert.Subject.Names {
+			if s, ok := n.Value.(string); ok && c.email == "" &&
+				n.Type.Equal(oidEmailAddress) {
+				c.email = s
+			}
+		}
+
+		certs = append(certs, c)
+
+	}
+
+	return certs, nil
+
+}
+
+// Reads the serials in a register.  The register has a serial= line for
+// each certificate, revoke_register has a line per certificate starting with
+// its serial.  A register which doesn't exist is empty.
+func readSerials(path string, register bool) (map[string]bool, error) {
+
+	serials := map[string]bool{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return serials, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if register {
+			if strings.HasPrefix(line, "serial=") {
+				serials[normaliseSerial(line)] = true
+			}
+		} else if line != "" {
+			serials[normaliseSerial(strings.Split(line, ",")[0])] = true
+		}
+	}
+
+	return serials, scanner.Err()
+
+}
+
+func readCA(env string, types []string) (*caState, error) {
+
+	ca := &caState{env: env, dir: Getenv(env, ""), types: types}
+
+	var err error
+	ca.live, err = readCerts(ca.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.revoked, err = readCerts(filepath.Join(ca.dir, "revoked"))
+	if err != nil {
+		return nil, err
+	}
+
+	ca.register, err = readSerials(filepath.Join(ca.dir, "register"), true)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.revokeRegister, err = readSerials(filepath.Join(ca.dir,
+		"revoke_register"), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+
+}
+
+// Whether a CA signs certificates for an entry type.
+func (ca *caState) signs(kind string) bool {
+	for _, t := range ca.types {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Live certificates which haven't been revoked.  A certificate in
+// revoke_register which is still with the live ones counts as revoked.
+func (ca *caState) current() []*caCert {
+	var certs []*caCert
+	for _, c := range ca.live {
+		if !ca.revokeRegister[c.serial] {
+			certs = append(certs, c)
+		}
+	}
+	return certs
+}
+
+// Certificates which have been revoked.
+func (ca *caState) revokedCerts() []*caCert {
+	certs := ca.revoked
+	for _, c := range ca.live {
+		if ca.revokeRegister[c.serial] {
+			certs = append(certs, c)
+		}
+	}
+	return certs
+}
+
+// Finds a user's certificate by common name.
+func findCert(certs []*caCert, user, cn string) *caCert {
+	for _, c := range certs {
+		if strings.EqualFold(c.email, user) && c.cn == cn {
+			return c
+		}
+	}
+	return nil
+}
+
+// Finds the certificate an entry was issued with: the user's, with the
+// entry's ID as its common name and the entry's end date.  INDEX entries
+// don't record serials, and names are reused, so the date is what tells an
+// entry's certificate from an earlier one by the same name.
+func findEntryCert(certs []*caCert, user string, e IndexEntry) *caCert {
+
+	end, err := ParseIndexDate(e.Common().End)
+	if err != nil {
+		return nil
+	}
+
+	for _, c := range certs {
+		if strings.EqualFold(c.email, user) && c.cn == e.ID() &&
+			c.notAfter.Equal(end) {
+			return c
+		}
+	}
+
+	return nil
+
+}
+
+// Moves a certificate, and its package, to revoked/, as the revoke scripts
+// do.  Packages are pkg.<serial>.p12, or pkg.<serial>.ovpn.
+func moveToRevoked(ca *caState, c *caCert) error {
+
+	dir := filepath.Join(ca.dir, "revoked")
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	serial := strings.TrimPrefix(filepath.Base(c.path), "cert.")
+	files, err := filepath.Glob(filepath.Join(ca.dir, "pkg."+serial+".*"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range append(files, c.path) {
+		err = os.Rename(f, filepath.Join(dir, filepath.Base(f)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Checks the CAs against their registers.
+func checkCAs(cas []*caState) ([]*problem, []*repair) {
+
+	var problems []*problem
+	var repairs []*repair
+
+	for _, ca := range cas {
+
+		for _, c := range ca.live {
+
+			c := c
+			ca := ca
+
+			if ca.revokeRegister[c.serial] {
+				problems = append(problems, &problem{
+					user:       c.email,
+					kind:       "revoked but live",
+					detail:     ca.env + " " + c.serial + " " + c.cn,
+					repairable: true,
+				})
+				repairs = append(repairs, &repair{
+					user: c.email,
+					apply: func() error {
+						return moveToRevoked(ca, c)
+					},
+				})
+			}
+
+			if !ca.register[c.serial] {
+				problems = append(problems, &problem{
+					user:   c.email,
+					kind:   "not in register",
+					detail: ca.env + " " + c.serial + " " + c.cn,
+				})
+			}
+
+		}
+
+		for _, c := range ca.revoked {
+			if !ca.revokeRegister[c.serial] {
+				problems = append(problems, &problem{
+					user:   c.email,
+					kind:   "not in revoke_register",
+					detail: ca.env + " " + c.serial + " " + c.cn,
+				})
+			}
+		}
+
+	}
+
+	return problems, repairs
+
+}
+
+// Removes entries from a user's INDEX, then deletes objects.  The INDEX is
+// written first, so that it never names objects which have gone.
+func repairUser(svc ObjectStore, user string, generation int64, index *Index, remove []IndexEntry, objects []string) error {
+
+	bucket := Getenv("BUCKET", "")
+
+	if len(remove) > 0 {
+
+		var kept []IndexEntry
+		for _, e := range index.Entries {
+			removed := false
+			for _, r := range remove {
+				if e == r {
+					removed = true
+				}
+			}
+			if !removed {
+				kept = append(kept, e)
+			}
+		}
+		index.Entries = kept
+
+		content, err := index.Marshal()
+		if err != nil {
+			return err
+		}
+
+		err = svc.Put(bucket, user+"/INDEX", strings.NewReader(string(content)),
+			generation, nil)
+		if err == ErrPreconditionFailed {
+			return fmt.Errorf("INDEX changed while checking, run again")
+		}
+		if err != nil {
+			return err
+		}
+
+	}
+
+	for _, o := range objects {
+		err := svc.Delete(bucket, user+"/"+o)
+		if err != nil && err != ErrObjectNotFound {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Checks a user's INDEX against their objects and the CAs.
+func checkUser(svc ObjectStore, user string, cas []*caState, now time.Time) ([]*problem, *repair, error) {
+
+	bucket := Getenv("BUCKET", "")
+
+	index, generation, err := ReadIndex(svc, bucket, user)
+	if err != nil {
+		return []*problem{{user: user, kind: "bad INDEX",
+			detail: err.Error()}}, nil, nil
+	}
+
+	names, err := svc.List(bucket, user+"/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exists := map[string]bool{}
+	for _, n := range names {
+		exists[strings.TrimPrefix(n, user+"/")] = true
+	}
+
+	var problems []*problem
+
+	// Entries to remove, and objects to delete, on repair.
+	var remove []IndexEntry
+	var deletes []string
+
+	referenced := map[string]bool{"INDEX": true, keyRecordObject: true}
+	for _, o := range index.Objects() {
+		referenced[o] = true
+	}
+
+	// Entries which can't be decoded don't say which objects they name.
+	unreadable := false
+
+	for _, e := range index.Entries {
+
+		id := e.Type() + " " + e.ID()
+
+		if err := e.Validate(); err != nil {
+			problems = append(problems, &problem{
+				user:   user,
+				kind:   "bad entry",
+				detail: err.Error(),
+			})
+			if _, ok := e.(*RawEntry); ok {
+				unreadable = true
+				continue
+			}
+		}
+
+		var missing, present []string
+		for _, o := range e.Objects() {
+			if exists[o] {
+				present = append(present, o)
+			} else {
+				missing = append(missing, o)
+			}
+		}
+
+		if len(missing) > 0 {
+			problems = append(problems, &problem{
+				user:       user,
+				kind:       "missing objects",
+				detail:     id + ": " + strings.Join(missing, ","),
+				repairable: true,
+			})
+			remove = append(remove, e)
+			deletes = append(deletes, present...)
+			continue
+		}
+
+		for _, ca := range cas {
+
+			if !ca.signs(e.Type()) {
+				continue
+			}
+
+			if findCert(ca.current(), user, e.ID()) != nil {
+				break
+			}
+
+			if c := findEntryCert(ca.revokedCerts(), user, e); c != nil {
+				problems = append(problems, &problem{
+					user:       user,
+					kind:       "revoked certificate",
+					detail:     id + ": " + ca.env + " " + c.serial,
+					repairable: true,
+				})
+				remove = append(remove, e)
+				deletes = append(deletes, present...)
+				break
+			}
+
+			// A revoked certificate by the same name might be an
+			// earlier one, so this isn't enough to remove the entry.
+			if c := findCert(ca.revokedCerts(), user, e.ID()); c != nil {
+				problems = append(problems, &problem{
+					user: user,
+					kind: "revoked certificate",
+					detail: id + ": " + ca.env + " " + c.serial +
+						", dates don't match the entry",
+				})
+				break
+			}
+
+			problems = append(problems, &problem{
+				user:   user,
+				kind:   "no certificate",
+				detail: id + ": not in " + ca.env,
+			})
+
+		}
+
+	}
+
+	var orphans []string
+	for n := range exists {
+		if !referenced[n] {
+			orphans = append(orphans, n)
+		}
+	}
+	sort.Strings(orphans)
+
+	for _, o := range orphans {
+		problems = append(problems, &problem{
+			user:       user,
+			kind:       "orphaned object",
+			detail:     o,
+			repairable: !unreadable,
+		})
+		if !unreadable {
+			deletes = append(deletes, o)
+		}
+	}
+
+	// Live certificates the user has no entry for.  Expired ones don't
+	// matter.
+	for _, ca := range cas {
+		for _, c := range ca.current() {
+
+			if !strings.EqualFold(c.email, user) || c.notAfter.Before(now) {
+				continue
+			}
+
+			found := false
+			for _, t := range ca.types {
+				if index.Find(t, c.cn) != nil {
+					found = true
+				}
+			}
+
+			if !found {
+				problems = append(problems, &problem{
+					user:   user,
+					kind:   "no INDEX entry",
+					detail: ca.env + " " + c.serial + " " + c.cn,
+				})
+			}
+
+		}
+	}
+
+	// The user's problems are repaired together, so that their INDEX is
+	// written once.
+	var fix *repair
+	if len(remove) > 0 || len(deletes) > 0 {
+		fix = &repair{
+			user: user,
+			apply: func() error {
+				return repairUser(svc, user, generation, index,
+					remove, deletes)
+			},
+		}
+	}
+
+	return problems, fix, nil
+
+}
+
+func main() {
+
+	doRepair := flag.Bool("repair", false, "Repair what can be repaired")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage:")
+		fmt.Println("  fsck-credentials [-repair] <key> [<user>]")
+		os.Exit(1)
+	}
+
+	// Read the key file
+	key, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
+	}
+
+	svc, err := ObjectStoreSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
+
+	var cas []*caState
+	for _, c := range fsckCAs {
+		if Getenv(c.env, "") == "" {
+			Log.Info("CA not set, not checking it", "ca", c.env)
+			continue
+		}
+		ca, err := readCA(c.env, c.types)
+		if err != nil {
+			Log.Error("Couldn't read CA", "ca", c.env, "error", err)
+			os.Exit(1)
+		}
+		cas = append(cas, ca)
+	}
+
+	var users []string
+	var problems []*problem
+	var repairs []*repair
+
+	if len(args) == 2 {
+
+		users = []string{args[1]}
+
+	} else {
+
+		users, err = ListUsers(svc, Getenv("BUCKET", ""))
+		if err != nil {
+			Log.Error("Couldn't list users", "error", err)
+			os.Exit(1)
+		}
+
+		// Users with certificates, but nothing in the bucket, are
+		// checked too.
+		seen := map[string]bool{}
+		for _, u := range users {
+			seen[strings.ToLower(u)] = true
+		}
+		for _, ca := range cas {
+			for _, c := range ca.live {
+				if c.email != "" && !seen[strings.ToLower(c.email)] {
+					seen[strings.ToLower(c.email)] = true
+					users = append(users, c.email)
+				}
+			}
+		}
+		sort.Strings(users)
+
+		problems, repairs = checkCAs(cas)
+
+	}
+
+	now := time.Now()
+	for _, user := range users {
+		p, fix, err := checkUser(svc, user, cas, now)
+		if err != nil {
+			Log.Error("Couldn't check user", "user", user, "error", err)
+			os.Exit(1)
+		}
+		problems = append(problems, p...)
+		if fix != nil {
+			repairs = append(repairs, fix)
+		}
+	}
+
+	unrepaired := 0
+	for _, p := range problems {
+		fmt.Printf("%s: %s: %s\n", p.user, p.kind, p.detail)
+		if !*doRepair || !p.repairable {
+			unrepaired++
+		}
+	}
+
+	if *doRepair {
+		for _, r := range repairs {
+			err := r.apply()
+			if err != nil {
+				fmt.Printf("%s: repair failed: %s\n", r.user, err)
+				unrepaired++
+				continue
+			}
+			fmt.Printf("%s: repaired\n", r.user)
+		}
+	}
+
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+
+}
@@ -14,7 +14,7 @@ func main() {
 	_, err := rand.Read(b[:])
 
 	if err != nil {
-		fmt.Printf("Random read: %s\n", err.Error())
+		Log.Error("Random read", "error", err)
 		os.Exit(1)
 	}
 
@@ -0,0 +1,247 @@
+package main
+
+// Lists users' credentials from their INDEX: each entry's type, device or
+// name, validity, days to expiry and the objects holding it.  Lists one
+// user's credentials, or every user's.  With -ids, lists only the device or
+// name, one per line, for scripts.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A credential, as listed.  Dates are RFC3339 where they can be parsed.
+type listing struct {
+	User    string   `json:"user"`
+	Type    string   `json:"type"`
+	ID      string   `json:"id"`
+	Start   string   `json:"start"`
+	End     string   `json:"end"`
+	Days    *int     `json:"days_to_expiry"`
+	Objects []string `json:"objects"`
+}
+
+// Parses -expiring-before, a date or an RFC3339 time.
+func parseCutoff(s string) (time.Time, error) {
+
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("Expected YYYY-MM-DD or RFC3339: " +
+			s)
+	}
+
+	return t, nil
+
+}
+
+// Formats a date as RFC3339, leaving it alone if it can't be parsed.
+func listDate(d string) string {
+	t, err := ParseIndexDate(d)
+	if err != nil {
+		return d
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Lists a user's credentials of a type ("" for all types), expiring before
+// cutoff if it's set.
+func listUser(svc ObjectStore, user, kind string, cutoff time.Time, now time.Time) ([]listing, error) {
+
+	index, _, err := ReadIndex(svc, Getenv("BUCKET", ""), user)
+	if err != nil {
+		return nil, err
+	}
+
+	var listings []listing
+	for _, e := range index.Entries {
+
+		if kind != "" && e.Type() != kind {
+			continue
+		}
+
+		c := e.Common()
+		l := listing{
+			User:    user,
+			Type:    e.Type(),
+			ID:      e.ID(),
+			Start:   listDate(c.Start),
+			End:     listDate(c.End),
+			Objects: e.Objects(),
+		}
+
+		end, err := ParseIndexDate(c.End)
+		if err == nil {
+			days := int(math.Floor(end.Sub(now).Hours() / 24))
+			l.Days = &days
+		}
+
+		// Credentials with no known end can't be said to expire before
+		// anything.
+		if !cutoff.IsZero() {
+			if err != nil {
+				Log.Warn("No end date", "user", user, "type", e.Type(),
+					"id", e.ID(), "error", err)
+				continue
+			}
+			if !end.Before(cutoff) {
+				continue
+			}
+		}
+
+		listings = append(listings, l)
+
+	}
+
+	return listings, nil
+
+}
+
+func printTable(listings []listing) {
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tTYPE\tID\tSTART\tEND\tDAYS\tOBJECTS")
+
+	for _, l := range listings {
+		days := "-"
+		if l.Days != nil {
+			days = fmt.Sprintf("%d", *l.Days)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.User, l.Type,
+			l.ID, l.Start, l.End, days, strings.Join(l.Objects, ","))
+	}
+
+	w.Flush()
+
+}
+
+// Prints each listing's ID on a line of its own.  Entries with no ID, or
+// one which would span lines, are left out and reported, returning false.
+func printIDs(listings []listing) bool {
+
+	ok := true
+	for _, l := range listings {
+		if l.ID == "" || strings.ContainsAny(l.ID, "\r\n") {
+			Log.Error("Can't list ID", "user", l.User, "type", l.Type,
+				"id", l.ID)
+			ok = false
+			continue
+		}
+		fmt.Println(l.ID)
+	}
+
+	return ok
+
+}
+
+func main() {
+
+	kind := flag.String("type", "",
+		"Only list credentials of this type: vpn, web, probe or vpn-service")
+	expiring := flag.String("expiring-before", "",
+		"Only list credentials expiring before this date, YYYY-MM-DD or "+
+			"RFC3339")
+	asJSON := flag.Bool("json", false, "Output JSON rather than a table")
+	idsOnly := flag.Bool("ids", false,
+		"Output only each credential's device or name, one per line")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 1 || len(args) > 2 || (*asJSON && *idsOnly) {
+		fmt.Println("Usage:")
+		fmt.Println("  list-credentials [-type <type>] " +
+			"[-expiring-before <date>] [-json|-ids] <key> [<user>]")
+		os.Exit(1)
+	}
+
+	if *kind != "" {
+		_, err := newIndexEntry(*kind)
+		if err != nil {
+			Log.Error("Bad type", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var cutoff time.Time
+	if *expiring != "" {
+		var err error
+		cutoff, err = parseCutoff(*expiring)
+		if err != nil {
+			Log.Error("Bad date", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Read the key file
+	key, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
+	}
+
+	svc, err := ObjectStoreSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
+
+	var users []string
+	if len(args) == 2 {
+		users = []string{args[1]}
+	} else {
+		users, err = ListUsers(svc, Getenv("BUCKET", ""))
+		if err != nil {
+			Log.Error("Couldn't list users", "error", err)
+			os.Exit(1)
+		}
+		sort.Strings(users)
+	}
+
+	// A user whose INDEX can't be read doesn't stop the others being
+	// listed, but is reported in the exit status.
+	now := time.Now()
+	failed := false
+	listings := []listing{}
+	for _, user := range users {
+		l, err := listUser(svc, user, *kind, cutoff, now)
+		if err != nil {
+			Log.Error("Couldn't read INDEX", "user", user, "error", err)
+			failed = true
+			continue
+		}
+		listings = append(listings, l...)
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(listings, "", "  ")
+		if err != nil {
+			Log.Error("Couldn't encode", "error", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	} else if *idsOnly {
+		if !printIDs(listings) {
+			failed = true
+		}
+	} else {
+		printTable(listings)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+
+}
@@ -0,0 +1,112 @@
+package main
+
+// Finds users' keys.  Given a user, prints the resource name of their key.
+// With -list, prints every user's key, with its labels.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Prints a line for each user: user, key resource name and labels, tab
+// separated.
+func listKeys(km KeyManager, ssvc ObjectStore) error {
+
+	users, err := ListUsers(ssvc, Getenv("BUCKET", ""))
+	if err != nil {
+		return err
+	}
+	sort.Strings(users)
+
+	for _, user := range users {
+
+		name, err := ResolveKeyName(ssvc, user)
+		if err != nil {
+			return err
+		}
+
+		exists, err := km.KeyExists(name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			fmt.Printf("%s\t%s\tno key\n", user, name)
+			continue
+		}
+
+		labels, err := km.Labels(name)
+		if err != nil {
+			return err
+		}
+
+		pairs := make([]string, 0, len(labels))
+		for k, v := range labels {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+
+		fmt.Printf("%s\t%s\t%s\n", user, name, strings.Join(pairs, ","))
+
+	}
+
+	return nil
+
+}
+
+func main() {
+
+	list := flag.Bool("list", false, "List every user's key, with labels")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 1 || (!*list && len(args) != 2) {
+		fmt.Println("Usage:")
+		fmt.Println("  lookup-key <key> <user>")
+		fmt.Println("  lookup-key -list <key>")
+		os.Exit(1)
+	}
+
+	// Read the key file
+	key, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
+	}
+
+	ssvc, err := ObjectStoreSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
+
+	if *list {
+
+		km, err := KeyManagerSignin(key)
+		if err != nil {
+			Log.Error("Couldn't connect", "error", err)
+			os.Exit(1)
+		}
+
+		err = listKeys(km, ssvc)
+		if err != nil {
+			Log.Error("Couldn't list keys", "error", err)
+			os.Exit(1)
+		}
+
+		return
+
+	}
+
+	name, err := ResolveKeyName(ssvc, args[1])
+	if err != nil {
+		Log.Error("Couldn't find key", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(name)
+
+}
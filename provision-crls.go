@@ -0,0 +1,16 @@
+package main
+
+// Handler which regenerates and publishes all CRLs.
+
+func init() {
+
+	// No parameters, so nothing to validate.
+	RegisterHandler("create-crls", &Handler{
+		Desc: "Creating all CRLs",
+		Execute: runScript("./create-all-crls", func(msg *Message) []string {
+			return nil
+		}),
+		PublishesCRL: true,
+	})
+
+}
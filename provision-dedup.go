@@ -0,0 +1,187 @@
+package main
+
+// Idempotent request handling.
+//
+// Requests may carry a client-supplied request ID.  Once such a request has
+// been dealt with, its response is recorded in a dedup store, and a replay of
+// the request gets the original response rather than being executed again.
+// This matters because the create scripts revoke the user's existing
+// credential first, so running a request twice would silently reissue it.
+//
+// The store is configured with DEDUP_STORE, which is one of:
+//   dir:/path/to/directory    - JSON files on local disk
+//   store:bucket/prefix       - objects in the object store picked by
+//                               STORAGE_BACKEND
+//   gs://bucket/prefix        - the same, as older deployments have it
+// If not set, requests aren't deduplicated.  Records in an object store are
+// only written if there isn't one already, so the first response recorded
+// for a request is the one replayed.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Records the response to each completed request.
+type DedupStore interface {
+
+	// Returns the recorded response, or nil if there isn't one.
+	Get(key string) (*MessageResponse, error)
+
+	// Records a response.
+	Put(key string, resp *MessageResponse) error
+}
+
+// Key under which a request's response is recorded, or "" if the request
+// has no request ID.  Request IDs are scoped to the user, so that one user
+// can't replay another's response.
+func dedupKey(msg *Message) string {
+	if msg.RequestId == "" {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(msg.User))
+	h.Write([]byte{0})
+	h.Write([]byte(msg.RequestId))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Create the dedup store described by DEDUP_STORE.  Returns nil if
+// deduplication isn't configured.
+func DedupStoreFromEnv(key []byte) (DedupStore, error) {
+
+	cfg := Getenv("DEDUP_STORE", "")
+
+	switch {
+
+	case cfg == "":
+		return nil, nil
+
+	case strings.HasPrefix(cfg, "dir:"):
+		dir := strings.TrimPrefix(cfg, "dir:")
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		return &dirDedupStore{dir: dir}, nil
+
+	case strings.HasPrefix(cfg, "store:"), strings.HasPrefix(cfg, "gs://"):
+		loc := strings.TrimPrefix(strings.TrimPrefix(cfg, "store:"), "gs://")
+		parts := strings.SplitN(loc, "/", 2)
+		prefix := ""
+		if len(parts) > 1 && parts[1] != "" {
+			prefix = strings.TrimSuffix(parts[1], "/") + "/"
+		}
+		store, err := ObjectStoreSignin(key)
+		if err != nil {
+			return nil, err
+		}
+		return &bucketDedupStore{store: store, bucket: parts[0],
+			prefix: prefix}, nil
+
+	}
+
+	return nil, errors.New("DEDUP_STORE not understood: " + cfg)
+
+}
+
+// Dedup store keeping a JSON file per request in a local directory.
+type dirDedupStore struct {
+	dir string
+}
+
+func (s *dirDedupStore) Get(key string) (*MessageResponse, error) {
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp MessageResponse
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+
+}
+
+func (s *dirDedupStore) Put(key string, resp *MessageResponse) error {
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash never leaves a partial record.
+	tmp := filepath.Join(s.dir, "."+key+".tmp")
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(s.dir, key))
+
+}
+
+// Dedup store keeping an object per request in an object store bucket.
+type bucketDedupStore struct {
+	store  ObjectStore
+	bucket string
+	prefix string
+}
+
+func (s *bucketDedupStore) Get(key string) (*MessageResponse, error) {
+
+	r, _, err := s.store.Open(s.bucket, s.prefix+key)
+	if err == ErrObjectNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var mr MessageResponse
+	err = json.Unmarshal(data, &mr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mr, nil
+
+}
+
+func (s *bucketDedupStore) Put(key string, resp *MessageResponse) error {
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	// Generation 0: only written if there's no record yet.  If there is,
+	// a replay raced with the original and the earlier record stands.
+	err = s.store.Put(s.bucket, s.prefix+key, bytes.NewReader(data), 0,
+		&ObjectAttrs{ContentType: "application/json"})
+	if err == ErrPreconditionFailed {
+		return nil
+	}
+	return err
+
+}
@@ -0,0 +1,187 @@
+package main
+
+// Request handler registry for the credential provisioner.
+//
+// Each request type (vpn, revoke-web, create-crls etc.) is implemented by a
+// Handler, which is registered from an init function in its own provision-*.go
+// file.  Adding a new credential type means adding a new file, the main loop
+// in credential-provision.go doesn't need to change.
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// A request handler.
+type Handler struct {
+
+	// Description of the action, used in log output e.g. "Creating vpn key"
+	Desc string
+
+	// Checks the request parameters.  Returns an error describing the
+	// problem if the request can't be actioned.  May be nil if there's
+	// nothing to check.
+	Validate func(msg *Message) error
+
+	// Carries out the request.  A failure should be returned as a
+	// *HandlerError so that the requester can be told why.
+	Execute func(msg *Message) (*Result, error)
+
+	// True if the handler regenerates and publishes CRLs.
+	PublishesCRL bool
+}
+
+// Outcome of executing a request.
+type Result struct {
+
+	// Output captured from the script.
+	Stdout []byte
+	Stderr []byte
+
+	// Certificate issued, if any.
+	Cert *CertInfo
+}
+
+// Handlers, keyed by request type.
+var handlers = map[string]*Handler{}
+
+// Register a handler for a request type.  Intended to be called from init
+// functions, registering the same type twice is a programming error.
+func RegisterHandler(kind string, h *Handler) {
+	if _, ok := handlers[kind]; ok {
+		panic("Handler already registered for request type " + kind)
+	}
+	handlers[kind] = h
+}
+
+// Find the handler for a request type, returns nil if there isn't one.
+func LookupHandler(kind string) *Handler {
+	return handlers[kind]
+}
+
+// Runs an external command.  This is a variable so that handlers can be
+// exercised without running the real scripts.  The default stops the command
+// if shutdown runs out of time, see provision-shutdown.go.
+var runCommand = runInterruptible
+
+// Scripts report the class of failure in their exit status.
+var scriptExitCodes = map[int]string{
+	2: CodeCASigningFailed,
+	3: CodeKMSFailed,
+	4: CodeStorageFailed,
+	5: CodeAborted,
+}
+
+// Returns an Execute function which runs a script, with arguments taken
+// from the request.  Scripts which issue a certificate describe it in the
+// file named by the RESULT_FILE environment variable.
+func runScript(script string, args func(msg *Message) []string) func(msg *Message) (*Result, error) {
+	return func(msg *Message) (*Result, error) {
+
+		rf, err := ioutil.TempFile("", "result")
+		if err != nil {
+			return nil, &HandlerError{CodeExecutionFailed,
+				"Couldn't create result file: " + err.Error()}
+		}
+		rf.Close()
+		defer os.Remove(rf.Name())
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(script, args(msg)...)
+		cmd.Env = append(os.Environ(), "RESULT_FILE="+rf.Name())
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		err = runCommand(cmd)
+
+		res := &Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+
+		if err != nil {
+			code := CodeExecutionFailed
+			if ee, ok := err.(*exec.ExitError); ok {
+				if c, ok := scriptExitCodes[ee.ExitCode()]; ok {
+					code = c
+				}
+			}
+			return res, &HandlerError{code, script + ": " + err.Error()}
+		}
+
+		res.Cert, err = readResultFile(rf.Name())
+		if err != nil {
+			return res, &HandlerError{CodeExecutionFailed,
+				"Couldn't read result file: " + err.Error()}
+		}
+
+		return res, nil
+
+	}
+}
+
+// Reads key=value lines written by a script to its RESULT_FILE.  Returns nil
+// if the script didn't describe a certificate.
+func readResultFile(path string) (*CertInfo, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vals := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 {
+			vals[kv[0]] = kv[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if vals["serial"] == "" {
+		return nil, nil
+	}
+
+	return &CertInfo{
+		Serial:    vals["serial"],
+		NotBefore: opensslDate(vals["start"]),
+		NotAfter:  opensslDate(vals["end"]),
+	}, nil
+
+}
+
+// Source: https://socketloop.com/tutorials/golang-validate-email-address-with-regular-expression
+//
+// Simple regex based email validity check
+var emailRe = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
+
+func validateEmail(email string) bool {
+	return emailRe.MatchString(email)
+}
+
+// Validator for requests which only need a user.
+func validateUser(msg *Message) error {
+	if !validateEmail(msg.User) {
+		return &HandlerError{CodeValidationFailed,
+			"invalid user email address"}
+	}
+	return nil
+}
+
+// Validator for requests which need a user and credential identity.
+func validateUserIdentity(msg *Message) error {
+	if err := validateUser(msg); err != nil {
+		return err
+	}
+	if msg.Identity == "" {
+		return &HandlerError{CodeValidationFailed,
+			"identity not specified"}
+	}
+	return nil
+}
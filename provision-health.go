@@ -0,0 +1,151 @@
+package main
+
+// Health and readiness endpoints for the credential provisioner.
+//
+//   GET /healthz    Liveness: the process is up and serving.  Deliberately
+//                   doesn't check dependencies, restarting the pod wouldn't
+//                   fix a missing mount or a Pub/Sub outage.
+//   GET /readyz     Readiness: Pub/Sub is reachable, the CA directories are
+//                   mounted and writable, the boot-time CRL creation
+//                   succeeded, and the provisioner isn't shutting down.
+//
+// Both return 200 if healthy, 503 otherwise, with a JSON description of each
+// check.
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// CA directories which must be writable, by environment variable.
+var caDirs = []string{"VPN_CA", "WEB_CA", "PROBE_CA"}
+
+// Outcome of a single check.
+type Check struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Ok     bool             `json:"ok"`
+	Checks map[string]Check `json:"checks"`
+}
+
+// Dependency state, updated as the provisioner runs.
+type Health struct {
+	mutex sync.Mutex
+
+	pubsubErr  error
+	pubsubSeen bool
+
+	crlsErr  error
+	crlsSeen bool
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// Record the outcome of talking to Pub/Sub.
+func (h *Health) SetPubsub(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.pubsubSeen = true
+	h.pubsubErr = err
+}
+
+// Record the outcome of creating CRLs at boot.
+func (h *Health) SetBootCRLs(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.crlsSeen = true
+	h.crlsErr = err
+}
+
+// Run the readiness checks.
+func (h *Health) Readiness() *HealthReport {
+
+	r := &HealthReport{Ok: true, Checks: map[string]Check{}}
+
+	add := func(name string, err error) {
+		if err != nil {
+			r.Ok = false
+			r.Checks[name] = Check{Ok: false, Error: err.Error()}
+		} else {
+			r.Checks[name] = Check{Ok: true}
+		}
+	}
+
+	h.mutex.Lock()
+	if h.pubsubSeen {
+		add("pubsub", h.pubsubErr)
+	} else {
+		add("pubsub", errors.New("not connected yet"))
+	}
+	if h.crlsSeen {
+		add("boot-crls", h.crlsErr)
+	} else {
+		add("boot-crls", errors.New("not run yet"))
+	}
+	h.mutex.Unlock()
+
+	if shutdown.Draining() {
+		add("shutdown", errors.New("shutting down"))
+	} else {
+		add("shutdown", nil)
+	}
+
+	for _, env := range caDirs {
+		add(env, checkWritable(Getenv(env, ".")))
+	}
+
+	return r
+
+}
+
+// Checks a directory exists and can be written to.
+func checkWritable(dir string) error {
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(dir + " is not a directory")
+	}
+
+	f, err := ioutil.TempFile(dir, ".readyz")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+
+}
+
+// Add the health endpoints to a mux.
+func (h *Health) Register(mux *http.ServeMux) {
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, &HealthReport{Ok: true, Checks: map[string]Check{}})
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, h.Readiness())
+	})
+
+}
+
+func writeHealth(w http.ResponseWriter, r *HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(r)
+}
@@ -0,0 +1,236 @@
+package main
+
+// HTTP/JSON API for the credential provisioner.
+//
+// Accepts the same Message payloads as the Pub/Sub request queue, for
+// internal tools which don't have Pub/Sub access.  Requests run through the
+// same handlers and worker pool as Pub/Sub requests, so work for a user is
+// still serialised.
+//
+//   POST /requests            Submit a request.  Waits for the response,
+//                             unless ?async=true is given.
+//   GET  /jobs/{id}           Status of a submitted request.
+//
+// Both return a Job.  A synchronous request which is still running when the
+// client goes away carries on, and can be followed up with GET /jobs/{id}.
+//
+// Requests must carry API_TOKEN as a bearer token.  If API_TOKEN isn't set
+// the API refuses every request; only the health and metrics endpoints are
+// open.
+//
+// Unlike Pub/Sub requests, transient failures aren't retried, the failure
+// is returned and the client can resubmit.  That includes requests caught by
+// shutdown, which fail with the aborted code.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// How long finished jobs are kept for status requests.
+const jobRetention = time.Hour
+
+// Largest request body accepted.
+const maxRequestSize = 64 * 1024
+
+type Job struct {
+	Id       string           `json:"id"`
+	Status   string           `json:"status"`
+	Response *MessageResponse `json:"response,omitempty"`
+
+	// Closed when the job is done.
+	done     chan struct{}
+	finished time.Time
+}
+
+// In-memory job table.
+type jobStore struct {
+	mutex sync.Mutex
+	jobs  map[string]*Job
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{jobs: map[string]*Job{}}
+}
+
+// Create a new queued job.
+func (s *jobStore) New() *Job {
+
+	j := &Job{
+		Id:     uuid.New().String(),
+		Status: JobQueued,
+		done:   make(chan struct{}),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Tidy up old jobs while we're here.
+	now := time.Now()
+	for id, old := range s.jobs {
+		if old.Status == JobDone && now.Sub(old.finished) > jobRetention {
+			delete(s.jobs, id)
+		}
+	}
+
+	s.jobs[j.Id] = j
+	return j
+
+}
+
+// Returns a copy of a job, safe to encode, or nil if it doesn't exist.
+func (s *jobStore) Get(id string) *Job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	c := *j
+	return &c
+}
+
+func (s *jobStore) SetRunning(j *Job) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j.Status = JobRunning
+}
+
+func (s *jobStore) SetDone(j *Job, resp *MessageResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j.Status = JobDone
+	j.Response = resp
+	j.finished = time.Now()
+	close(j.done)
+}
+
+type apiServer struct {
+	prov  *Provisioner
+	pool  *WorkerPool
+	jobs  *jobStore
+	token string
+}
+
+func newAPIServer(prov *Provisioner, pool *WorkerPool) *apiServer {
+	return &apiServer{
+		prov:  prov,
+		pool:  pool,
+		jobs:  newJobStore(),
+		token: Getenv("API_TOKEN", ""),
+	}
+}
+
+// Add the API endpoints to a mux.
+func (s *apiServer) Register(mux *http.ServeMux) {
+	if s.token == "" {
+		Log.Warn("API_TOKEN not set, API requests will be refused")
+	}
+	mux.HandleFunc("/requests", s.authorised(s.handleRequest))
+	mux.HandleFunc("/jobs/", s.authorised(s.handleJob))
+}
+
+// Wraps a handler with the bearer token check.  With no token configured
+// nothing is authorised.
+func (s *apiServer) authorised(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(tok),
+			[]byte(s.token)) != 1 {
+			http.Error(w, "Unauthorised", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// POST /requests
+func (s *apiServer) handleRequest(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if shutdown.Draining() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	var msg Message
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	err := dec.Decode(&msg)
+	if err != nil {
+		http.Error(w, "Couldn't make sense of request: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+
+	j := s.jobs.New()
+
+	requestLog(&msg, j.Id).Info("HTTP request")
+
+	ok := s.pool.Submit(msg.User, func() {
+		s.jobs.SetRunning(j)
+		resp, _ := s.prov.Process(&msg, j.Id)
+		s.jobs.SetDone(j, resp)
+	})
+	if !ok {
+		s.jobs.SetDone(j, abortedResponse(&msg, j.Id))
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		writeJob(w, http.StatusAccepted, s.jobs.Get(j.Id))
+		return
+	}
+
+	select {
+	case <-j.done:
+		writeJob(w, http.StatusOK, s.jobs.Get(j.Id))
+	case <-r.Context().Done():
+		// Client went away, nothing to write to.
+	}
+
+}
+
+// GET /jobs/{id}
+func (s *apiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	j := s.jobs.Get(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if j == nil {
+		http.Error(w, "No such job", http.StatusNotFound)
+		return
+	}
+
+	writeJob(w, http.StatusOK, j)
+
+}
+
+func writeJob(w http.ResponseWriter, status int, j *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		Log.Error("Couldn't write response", "job", j.Id, "error", err)
+	}
+}
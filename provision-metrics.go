@@ -0,0 +1,196 @@
+package main
+
+// Prometheus metrics for the credential provisioner, served on /metrics.
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Certificates expiring within this window are counted as expiring.
+const expiryWindow = 30 * 24 * time.Hour
+
+// How often CA directories are scanned for expiring certificates.
+const expiryScanInterval = 10 * time.Minute
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "credential_requests_total",
+			Help: "Provisioning requests processed, by type and outcome.",
+		},
+		[]string{"type", "outcome"},
+	)
+
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "credential_request_duration_seconds",
+			Help: "Time taken to process provisioning requests.",
+			// Key creation with DH params can take minutes.
+			Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60,
+				120, 300, 600},
+		},
+		[]string{"type"},
+	)
+
+	pullErrorsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "credential_pubsub_pull_errors_total",
+			Help: "Failed Pub/Sub pull requests.",
+		},
+	)
+
+	pullErrorsConsecutive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "credential_pubsub_pull_errors_consecutive",
+			Help: "Pub/Sub pull failures since the last success.",
+		},
+	)
+
+	certsExpiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "credential_certificates_expiring",
+			Help: "Live certificates expiring in the next 30 days, by CA.",
+		},
+		[]string{"ca"},
+	)
+
+	// Time of last successful CRL publication.
+	crlMutex       sync.Mutex
+	crlLastSuccess time.Time
+)
+
+func init() {
+
+	prometheus.MustRegister(requestsTotal, requestDuration,
+		pullErrorsTotal, pullErrorsConsecutive, certsExpiring)
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "credential_crl_last_success_age_seconds",
+			Help: "Time since CRLs were last successfully published.",
+		},
+		func() float64 {
+			crlMutex.Lock()
+			defer crlMutex.Unlock()
+			if crlLastSuccess.IsZero() {
+				return -1
+			}
+			return time.Since(crlLastSuccess).Seconds()
+		},
+	))
+
+}
+
+// Record a processed request.
+func observeRequest(msg *Message, resp *MessageResponse, replayed bool) {
+
+	// Request type comes from the client, don't let arbitrary values
+	// through as labels.
+	kind := msg.Type
+	if LookupHandler(kind) == nil {
+		kind = "unknown"
+	}
+
+	outcome := "success"
+	switch {
+	case replayed:
+		outcome = "replayed"
+	case !resp.Success:
+		outcome = resp.Code
+	}
+
+	requestsTotal.WithLabelValues(kind, outcome).Inc()
+
+	if !replayed {
+		requestDuration.WithLabelValues(kind).
+			Observe(float64(resp.Duration) / 1000)
+	}
+
+}
+
+// Record the outcome of a Pub/Sub pull.
+func observePull(err error) {
+	if err != nil {
+		pullErrorsTotal.Inc()
+		pullErrorsConsecutive.Inc()
+	} else {
+		pullErrorsConsecutive.Set(0)
+	}
+}
+
+// Record a successful CRL publication.
+func observeCRLPublished() {
+	crlMutex.Lock()
+	defer crlMutex.Unlock()
+	crlLastSuccess = time.Now()
+}
+
+// Periodically count expiring certificates in each CA directory.  Doesn't
+// return.
+func watchExpiry() {
+	for {
+		now := time.Now()
+		for _, env := range caDirs {
+			ca := strings.ToLower(strings.TrimSuffix(env, "_CA"))
+			n, err := countExpiring(Getenv(env, "."), now)
+			if err == nil {
+				certsExpiring.WithLabelValues(ca).Set(float64(n))
+			}
+		}
+		time.Sleep(expiryScanInterval)
+	}
+}
+
+// Counts live certificates in a CA directory which expire within the expiry
+// window.  Signed certificates are kept as cert.<serial>, revoked ones are
+// moved to the revoked directory so aren't counted.
+func countExpiring(dir string, now time.Time) (int, error) {
+
+	files, err := filepath.Glob(filepath.Join(dir, "cert.*"))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, f := range files {
+
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+
+		if cert.NotAfter.After(now) &&
+			cert.NotAfter.Before(now.Add(expiryWindow)) {
+			count++
+		}
+
+	}
+
+	return count, nil
+
+}
+
+// Add the metrics endpoint to a mux.
+func registerMetrics(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+}
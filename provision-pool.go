@@ -0,0 +1,131 @@
+package main
+
+// Bounded worker pool for the credential provisioner.
+//
+// Requests are processed concurrently, up to the pool size, but work for
+// any one user is serialised.  The create and revoke scripts read-modify-write
+// the user's INDEX and revoke certs found by user, so two requests for the
+// same user mustn't run at once.  Different users proceed in parallel.
+
+import (
+	"sync"
+)
+
+type WorkerPool struct {
+
+	// Holds a token for each busy worker.
+	slots chan struct{}
+
+	// Work queued for each user with work in the pool.  The head of the
+	// queue is running, or waiting for a worker; the rest waits for it.
+	mutex sync.Mutex
+	users map[string][]func()
+
+	// Number of items, running or queued, across all users.
+	queued int
+
+	// Signalled when an item completes.
+	idle *sync.Cond
+
+	// Set once the pool stops accepting work.
+	closed bool
+
+	// Tracks outstanding work.
+	wg sync.WaitGroup
+}
+
+// Create a worker pool which runs at most size requests at once.
+func NewWorkerPool(size int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &WorkerPool{
+		slots: make(chan struct{}, size),
+		users: map[string][]func(){},
+	}
+	p.idle = sync.NewCond(&p.mutex)
+	return p
+}
+
+// Blocks until fewer items than workers are in the pool, and returns the
+// number of items which can be submitted without any waiting for a worker.
+// Items queued behind a busy user count too, so the caller doesn't pull
+// more work than can start soon.  The count is a snapshot, other goroutines
+// calling Submit may take workers before the caller does.
+func (p *WorkerPool) WaitFree() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for p.queued >= cap(p.slots) {
+		p.idle.Wait()
+	}
+	return cap(p.slots) - p.queued
+}
+
+// Queues fn to run on a worker, once no other work for the user is in
+// progress.  A worker is only taken when it's the user's turn, so work for
+// a busy user doesn't hold up anyone else.  Returns false, without queueing
+// fn, if the pool has been closed.
+func (p *WorkerPool) Submit(user string, fn func()) bool {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	// Counted as outstanding while queued, so that Wait covers it.
+	p.wg.Add(1)
+	p.queued++
+
+	queue, busy := p.users[user]
+	p.users[user] = append(queue, fn)
+	if !busy {
+		go p.run(user)
+	}
+
+	return true
+
+}
+
+// Stop accepting work.  Work already submitted still runs.
+func (p *WorkerPool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+}
+
+// Waits for all submitted work to complete.
+func (p *WorkerPool) Wait() {
+	p.wg.Wait()
+}
+
+// Works through a user's queue, one item at a time, until it's empty.
+func (p *WorkerPool) run(user string) {
+
+	for {
+
+		p.mutex.Lock()
+		fn := p.users[user][0]
+		p.mutex.Unlock()
+
+		p.slots <- struct{}{}
+		fn()
+		<-p.slots
+		p.wg.Done()
+
+		p.mutex.Lock()
+		p.queued--
+		p.idle.Broadcast()
+		queue := p.users[user][1:]
+		if len(queue) == 0 {
+			delete(p.users, user)
+			p.mutex.Unlock()
+			return
+		}
+		p.users[user] = queue
+		p.mutex.Unlock()
+
+	}
+
+}
@@ -0,0 +1,36 @@
+package main
+
+// Probe credential handlers.
+
+// Probe credentials need a delivery endpoint.
+func validateProbe(msg *Message) error {
+	if err := validateUserIdentity(msg); err != nil {
+		return err
+	}
+	if msg.Endpoint == "" {
+		return &HandlerError{CodeValidationFailed,
+			"endpoint not specified"}
+	}
+	return nil
+}
+
+func init() {
+
+	RegisterHandler("probe", &Handler{
+		Desc:     "Creating probe key",
+		Validate: validateProbe,
+		Execute: runScript("./create-probe-key", func(msg *Message) []string {
+			return []string{msg.User, msg.Identity, msg.Endpoint}
+		}),
+	})
+
+	RegisterHandler("revoke-probe", &Handler{
+		Desc:     "Revoking probe key",
+		Validate: validateUser,
+		Execute: runScript("./revoke-probe-key", func(msg *Message) []string {
+			return []string{msg.User}
+		}),
+		PublishesCRL: true,
+	})
+
+}
@@ -0,0 +1,154 @@
+package main
+
+// Retry policy for failed provisioning requests.
+//
+// Failures are either transient (Cloud KMS or Storage were unavailable, or
+// the provisioner shut down mid-request) or permanent (bad parameters,
+// certificate signing failed, or any failure a script didn't classify).
+// Transient failures are redelivered with exponential backoff, up to a
+// maximum number of attempts.  A request which still fails is published to
+// the dead-letter topic along with the final error.
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Failure codes worth retrying.  Scripts tidy up after themselves on
+// failure, so re-running a request is safe.  Execution failures cover
+// everything a script doesn't give its own exit status, bad input included,
+// so aren't retried.
+var transientCodes = map[string]bool{
+	CodeKMSFailed:     true,
+	CodeStorageFailed: true,
+	CodeAborted:       true,
+}
+
+// Returns true if a failure with this code could go away on a retry.
+func IsTransient(code string) bool {
+	return transientCodes[code]
+}
+
+type RetryPolicy struct {
+
+	// Number of attempts before giving up, including the first.
+	MaxAttempts int
+
+	// Delay before the first retry, doubled for each subsequent retry.
+	Backoff time.Duration
+
+	// Upper limit on the delay.  Pub/Sub doesn't allow an ack deadline
+	// over 10 minutes.
+	MaxBackoff time.Duration
+}
+
+// Get retry policy from the environment.
+func RetryPolicyFromEnv() (*RetryPolicy, error) {
+
+	attempts, err := strconv.Atoi(Getenv("MAX_ATTEMPTS", "5"))
+	if err != nil {
+		return nil, err
+	}
+
+	backoff, err := time.ParseDuration(Getenv("RETRY_BACKOFF", "10s"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &RetryPolicy{
+		MaxAttempts: attempts,
+		Backoff:     backoff,
+		MaxBackoff:  600 * time.Second,
+	}, nil
+
+}
+
+// Returns true if a request with this response on the given attempt
+// (counting from 1) should be retried.
+func (p *RetryPolicy) ShouldRetry(resp *MessageResponse, attempt int) bool {
+	if resp.Success || !IsTransient(resp.Code) {
+		return false
+	}
+	return attempt < p.MaxAttempts
+}
+
+// Returns the delay before retrying after the given attempt.
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// How long a message's attempt count is kept after its last attempt, or
+// after its retry was scheduled.  A retry comes at most the longest backoff,
+// the 10 minute ack deadline, after that, so twice that covers it with room
+// to spare.  Messages acked by another provisioner, or lost, are forgotten
+// after this.
+const attemptTTL = 20 * time.Minute
+
+// Counts delivery attempts per message.  Pub/Sub only counts attempts for
+// subscriptions with a dead-letter policy, so the count is kept here.  It's
+// lost on restart, or after attemptTTL, which at worst gives a request a
+// few extra attempts.
+type attemptCounter struct {
+	mutex  sync.Mutex
+	counts map[string]*attemptCount
+}
+
+type attemptCount struct {
+	count int
+	last  time.Time
+}
+
+func newAttemptCounter() *attemptCounter {
+	return &attemptCounter{counts: map[string]*attemptCount{}}
+}
+
+// Record an attempt, returns the attempt number counting from 1.  Counts
+// not updated within attemptTTL are dropped.
+func (c *attemptCounter) Next(id string) int {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for k, a := range c.counts {
+		if now.Sub(a.last) > attemptTTL {
+			delete(c.counts, k)
+		}
+	}
+
+	a, ok := c.counts[id]
+	if !ok {
+		a = &attemptCount{}
+		c.counts[id] = a
+	}
+	a.count++
+	a.last = now
+
+	return a.count
+
+}
+
+// Note that a message's retry has been scheduled, so its count is kept for
+// attemptTTL from now, however long the attempt took.
+func (c *attemptCounter) Retrying(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if a, ok := c.counts[id]; ok {
+		a.last = time.Now()
+	}
+}
+
+// Forget a message which has been dealt with.
+func (c *attemptCounter) Done(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.counts, id)
+}
@@ -0,0 +1,16 @@
+package main
+
+// Handler which revokes all of a user's credentials.
+
+func init() {
+
+	RegisterHandler("revoke-all", &Handler{
+		Desc:     "Revoking all keys",
+		Validate: validateUser,
+		Execute: runScript("./revoke-all-key", func(msg *Message) []string {
+			return []string{msg.User}
+		}),
+		PublishesCRL: true,
+	})
+
+}
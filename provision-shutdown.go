@@ -0,0 +1,184 @@
+package main
+
+// Graceful shutdown for the credential provisioner.
+//
+// On SIGTERM or SIGINT the provisioner stops pulling requests, reports itself
+// not ready and refuses new HTTP requests.  Requests which haven't started
+// are handed back to Pub/Sub for redelivery, or failed with the aborted code
+// over HTTP, so that they can be picked up by the next provisioner.
+//
+// Running requests get SHUTDOWN_TIMEOUT (default 180s) to finish.  After that
+// their scripts are sent SIGTERM.  The create scripts trap it, let the current
+// step finish and then back out as they would after any other failure,
+// revoking a half-issued certificate.  Revoke and CRL scripts ignore it and
+// run to completion.  A script still running SHUTDOWN_KILL_TIMEOUT (default
+// 90s) later is killed.
+//
+// The pod's terminationGracePeriodSeconds needs to cover both timeouts.
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Shutdown struct {
+
+	// Cancelled when shutdown starts.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Closed when running scripts should be stopped.
+	abort     chan struct{}
+	abortOnce sync.Once
+
+	// Time allowed for running requests to finish.
+	Timeout time.Duration
+
+	// Time allowed for scripts to back out once stopped.
+	KillTimeout time.Duration
+}
+
+// Shutdown state for the process, scripts are run under it.
+var shutdown = newShutdown()
+
+func newShutdown() *Shutdown {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Shutdown{
+		ctx:         ctx,
+		cancel:      cancel,
+		abort:       make(chan struct{}),
+		Timeout:     180 * time.Second,
+		KillTimeout: 90 * time.Second,
+	}
+}
+
+// Get timeouts from the environment.
+func (s *Shutdown) ConfigureFromEnv() error {
+
+	timeout, err := time.ParseDuration(Getenv("SHUTDOWN_TIMEOUT", "180s"))
+	if err != nil {
+		return err
+	}
+
+	kill, err := time.ParseDuration(Getenv("SHUTDOWN_KILL_TIMEOUT", "90s"))
+	if err != nil {
+		return err
+	}
+
+	s.Timeout = timeout
+	s.KillTimeout = kill
+	return nil
+
+}
+
+// Start shutdown when the process is asked to stop.
+func (s *Shutdown) Notify() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-c
+		Log.Info("Shutting down", "signal", sig.String())
+		s.cancel()
+	}()
+}
+
+// Returns a context which is cancelled when shutdown starts.
+func (s *Shutdown) Context() context.Context {
+	return s.ctx
+}
+
+// True once shutdown has started.
+func (s *Shutdown) Draining() bool {
+	return s.ctx.Err() != nil
+}
+
+// Closes the pool and waits for outstanding work.  Scripts still running
+// after the timeout are stopped.  Returns false if work was still outstanding
+// once they'd had time to back out.
+func (s *Shutdown) Drain(pool *WorkerPool) bool {
+
+	done := make(chan struct{})
+	go func() {
+		pool.Close()
+		pool.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(s.Timeout):
+	}
+
+	Log.Warn("Shutdown timeout passed, stopping running requests")
+	s.abortOnce.Do(func() { close(s.abort) })
+
+	// Allow a little longer than the kill timeout, for killed requests to
+	// send their responses.
+	select {
+	case <-done:
+		return true
+	case <-time.After(s.KillTimeout + 10*time.Second):
+		return false
+	}
+
+}
+
+// Response to a request which wasn't run because of shutdown.
+func abortedResponse(msg *Message, id string) *MessageResponse {
+	return &MessageResponse{
+		Message:   *msg,
+		MessageId: id,
+		Started:   time.Now().UTC(),
+		Code:      CodeAborted,
+		Error:     "Provisioner is shutting down",
+	}
+}
+
+// Runs a command, stopping it if shutdown runs out of time.  The command is
+// sent SIGTERM, and if it hasn't exited after the kill timeout, it's killed
+// along with anything it started.
+func runInterruptible(cmd *exec.Cmd) error {
+
+	// Scripts get their own process group, so that a ^C at the terminal
+	// goes to the provisioner and not straight to the scripts.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-shutdown.abort:
+	}
+
+	// Only the script itself is signalled, the step it's running is
+	// left to finish.
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(shutdown.KillTimeout):
+	}
+
+	Log.Error("Script didn't stop, killing it", "script", cmd.Path,
+		"pid", cmd.Process.Pid)
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	return <-done
+
+}
@@ -0,0 +1,69 @@
+package main
+
+// Status reporting for provisioning requests.  Failures carry a
+// machine-readable code so that whoever is waiting on the response queue can
+// tell the user why their request failed.
+
+import (
+	"time"
+)
+
+// Failure codes reported in MessageResponse.
+const (
+	CodeValidationFailed = "validation_failed"
+	CodeCASigningFailed  = "ca_signing_failed"
+	CodeKMSFailed        = "kms_failed"
+	CodeStorageFailed    = "storage_failed"
+	CodeUnknownType      = "unknown_type"
+
+	// The provisioner shut down before the request completed.
+	CodeAborted = "aborted"
+
+	// Any other failure.
+	CodeExecutionFailed = "execution_failed"
+)
+
+// Maximum amount of script error output returned in a response.
+const stderrTailSize = 2048
+
+// A request failure.
+type HandlerError struct {
+	Code    string
+	Message string
+}
+
+func (e *HandlerError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Details of an issued certificate.
+type CertInfo struct {
+	Serial    string
+	NotBefore string
+	NotAfter  string
+}
+
+// Converts a date as output by openssl x509 -startdate to RFC3339.  Returns
+// the date unchanged if it can't be parsed.
+func opensslDate(d string) string {
+	t, err := time.Parse("Jan _2 15:04:05 2006 MST", d)
+	if err != nil {
+		return d
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Returns the end of a script's error output, starting at a line boundary
+// where possible.
+func stderrTail(stderr []byte) string {
+	if len(stderr) <= stderrTailSize {
+		return string(stderr)
+	}
+	tail := stderr[len(stderr)-stderrTailSize:]
+	for i, c := range tail {
+		if c == '\n' && i < len(tail)-1 {
+			return string(tail[i+1:])
+		}
+	}
+	return string(tail)
+}
@@ -0,0 +1,51 @@
+package main
+
+// VPN service credential handlers.
+
+// VPN service credentials need a host, allocator and probe credential.
+func validateVpnService(msg *Message) error {
+	if err := validateUserIdentity(msg); err != nil {
+		return err
+	}
+	if msg.Host == "" {
+		return &HandlerError{CodeValidationFailed,
+			"host not specified"}
+	}
+	if msg.Allocator == "" {
+		return &HandlerError{CodeValidationFailed,
+			"allocator not specified"}
+	}
+	if msg.ProbeCred == "" {
+		return &HandlerError{CodeValidationFailed,
+			"probe credential not specified"}
+	}
+	return nil
+}
+
+func init() {
+
+	RegisterHandler("vpn-service", &Handler{
+		Desc:     "Creating VPN service key",
+		Validate: validateVpnService,
+		Execute: runScript("./create-vpn-service-key",
+			func(msg *Message) []string {
+				return []string{msg.User, msg.Identity, msg.Host,
+					msg.Allocator, msg.ProbeCred}
+			}),
+	})
+
+	RegisterHandler("revoke-vpn-service", &Handler{
+		Desc:     "Revoking VPN service key",
+		Validate: validateUser,
+		Execute: runScript("./revoke-vpn-service-key",
+			func(msg *Message) []string {
+				// Without an identity, all the user's services.
+				if msg.Identity == "" {
+					return []string{msg.User}
+				}
+				return []string{msg.User, msg.Identity}
+			}),
+		PublishesCRL: true,
+	})
+
+}
@@ -0,0 +1,26 @@
+package main
+
+// VPN credential handlers.
+
+func init() {
+
+	RegisterHandler("vpn", &Handler{
+		Desc:     "Creating vpn key",
+		Validate: validateUserIdentity,
+		Execute: runScript("./create-vpn-key", func(msg *Message) []string {
+			return []string{msg.User, msg.Identity}
+		}),
+	})
+
+	// Identity is optional, if not specified all the user's VPN keys are
+	// revoked.
+	RegisterHandler("revoke-vpn", &Handler{
+		Desc:     "Revoking VPN key",
+		Validate: validateUser,
+		Execute: runScript("./revoke-vpn-key", func(msg *Message) []string {
+			return []string{msg.User, msg.Identity}
+		}),
+		PublishesCRL: true,
+	})
+
+}
@@ -0,0 +1,24 @@
+package main
+
+// Web certificate handlers.
+
+func init() {
+
+	RegisterHandler("web", &Handler{
+		Desc:     "Creating web key",
+		Validate: validateUserIdentity,
+		Execute: runScript("./create-web-key", func(msg *Message) []string {
+			return []string{msg.User, msg.Identity}
+		}),
+	})
+
+	RegisterHandler("revoke-web", &Handler{
+		Desc:     "Revoking web key",
+		Validate: validateUser,
+		Execute: runScript("./revoke-web-key", func(msg *Message) []string {
+			return []string{msg.User}
+		}),
+		PublishesCRL: true,
+	})
+
+}
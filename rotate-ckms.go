@@ -0,0 +1,142 @@
+package main
+
+// Rotates a user's crypto key, and re-wraps the data keys in their INDEX
+// under the new primary version, so that old versions can be disabled.
+//
+// Unwrapping needs decrypt permission on the user's key, which the
+// provisioner's service account doesn't have, so this is run by an admin.
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Unwraps a hex-encoded data key and wraps it again under the primary
+// version.
+func rewrapKey(km KeyManager, resourceName, wrapped string) (string, error) {
+
+	ciphertext, err := hex.DecodeString(wrapped)
+	if err != nil {
+		return "", errors.New("Couldn't decode key: " + err.Error())
+	}
+
+	plaintext, err := km.Decrypt(resourceName, ciphertext)
+	if err != nil {
+		return "", errors.New("Decrypt failed: " + err.Error())
+	}
+
+	ciphertext, _, err = km.Encrypt(resourceName, plaintext)
+	if err != nil {
+		return "", errors.New("Encrypt failed: " + err.Error())
+	}
+
+	return hex.EncodeToString(ciphertext), nil
+
+}
+
+// Re-wraps every data key in the INDEX.  A user without one has nothing to
+// re-wrap.
+func rewrapIndex(km KeyManager, svc ObjectStore, resourceName, user string) error {
+
+	bucket := Getenv("BUCKET", "")
+	path := user + "/INDEX"
+
+	return UpdateObject(svc, user, bucket, path,
+		func(data []byte, exists bool) ([]byte, error) {
+
+			if !exists {
+				return nil, ErrUnchanged
+			}
+
+			index, err := ParseIndex(data)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, entry := range index.Entries {
+
+				// Nothing to re-wrap for legacy entries without a key.
+				if entry.WrappedKey() == "" {
+					Log.Warn("Entry has no key", "type", entry.Type(),
+						"id", entry.ID())
+					continue
+				}
+
+				key, err := rewrapKey(km, resourceName, entry.WrappedKey())
+				if err != nil {
+					return nil, err
+				}
+
+				entry.SetWrappedKey(key)
+
+			}
+
+			Log.Info("Re-wrapped keys", "count", len(index.Entries))
+
+			return index.Marshal()
+
+		})
+
+}
+
+func main() {
+
+	rewrapOnly := flag.Bool("rewrap-only", false,
+		"Don't create a new version, just re-wrap under the primary "+
+			"e.g. after scheduled rotation")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) != 2 {
+		fmt.Println("Usage:")
+		fmt.Println("  rotate-ckms [-rewrap-only] <key> <user>")
+		os.Exit(1)
+	}
+
+	// Read the key file
+	key, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
+	}
+
+	user := args[1]
+
+	km, err := KeyManagerSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
+
+	svc, err := ObjectStoreSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
+
+	resourceName, err := ResolveKeyName(svc, user)
+	if err != nil {
+		Log.Error("Couldn't find key", "error", err)
+		os.Exit(1)
+	}
+
+	if !*rewrapOnly {
+		_, err = km.Rotate(resourceName)
+		if err != nil {
+			os.Exit(1)
+		}
+	}
+
+	err = rewrapIndex(km, svc, resourceName, user)
+	if err != nil {
+		Log.Error("Couldn't re-wrap keys", "error", err)
+		os.Exit(1)
+	}
+
+	Log.Info("Success")
+
+}
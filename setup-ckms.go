@@ -1,138 +1,295 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 
 	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
 )
 
-func initialiseKms(svc *cloudkms.Service, user string, isSa bool) error {
+func initialiseKms(km KeyManager, ssvc ObjectStore, user string, isSa bool) error {
 
-	// Get environment variables.
-	projectID := Getenv("PROJECT_ID", "")
-	keyRing := Getenv("KEY_RING", "")
-	serviceAccount := Getenv("SERVICE_ACCOUNT", "")
+	// Keys stay where they were created, settings only apply to new keys.
+	resourceName, err := RecordedKeyName(ssvc, user)
+	if err != nil {
+		Log.Error("Couldn't read key record", "error", err)
+		return err
+	}
 
-	cryptoKey := KeyID(user)
+	if resourceName == "" {
 
-	template := "projects/%s/locations/%s/keyRings/%s"
-	resourceName := fmt.Sprintf(template, projectID, "global", keyRing)
+		resourceName, err = createKey(km, user)
+		if err != nil {
+			return err
+		}
+
+		Log.Info("Record crypto key...", "key", resourceName)
+		err = RecordKeyName(ssvc, user, resourceName)
+		if err != nil {
+			Log.Error("Couldn't record key", "error", err)
+			return err
+		}
+
+	} else {
+		Log.Info("Crypto key exists", "key", resourceName)
+	}
 
-	fmt.Printf("Check for keyring %s...\n", keyRing)
-	_, err := svc.Projects.Locations.KeyRings.
-		Get(resourceName).Do()
+	err = km.Grant(resourceName, user, isSa)
 	if err != nil {
-		fmt.Printf("KeyRing get failed: %s\n",
-			err.Error())
-		fmt.Printf("Maybe key ring %s does not exist.\n", keyRing)
 		return err
 	}
 
-	fmt.Println("Key ring exists.")
+	Log.Info("Success")
 
-	template = "projects/%s/locations/%s/keyRings/%s"
-	resourceName = fmt.Sprintf(template, projectID, "global", keyRing)
+	return nil
 
-	ck := cloudkms.CryptoKey{
-		Purpose: "ENCRYPT_DECRYPT",
-	}
+}
+
+// Creates a user's crypto key with the settings for the user, and returns
+// its resource name.  Users whose key was created before keys were recorded
+// already have one in the global location, that's used instead.
+func createKey(km KeyManager, user string) (string, error) {
 
-	fmt.Println("Create crpyto key...")
-	_, err = svc.Projects.Locations.KeyRings.CryptoKeys.
-		Create(resourceName, &ck).CryptoKeyId(cryptoKey).Do()
+	legacy := OriginalKeyName(user)
+	exists, err := km.KeyExists(legacy)
 	if err != nil {
-		fmt.Printf("CryptoKey create failed: %s\n",
-			err.Error())
-		fmt.Println("Maybe it already exists.")
+		return "", err
+	}
+	if exists {
+		Log.Info("Crypto key exists in global location")
+		return legacy, nil
 	}
 
-	// Setup CloudKMS policy.
-	// - User can use key to decrypt.
-	// - Cred Service Account can use key to encrypt.
+	spec, err := KeySpecFor(user)
+	if err != nil {
+		Log.Error("Couldn't get key settings", "error", err)
+		return "", err
+	}
 
-	var uString string
-	if isSa {
-		uString = "serviceAccount:" + user
-	} else {
-		uString = "user:" + user
+	resourceName, err := KeyName(user, spec.Location)
+	if err != nil {
+		Log.Error("Couldn't name key", "error", err)
+		return "", err
 	}
 
-	var pol cloudkms.Policy
-	pol.Bindings = []*cloudkms.Binding{
-		&cloudkms.Binding{
-			Members: []string{uString},
-			Role:    "roles/cloudkms.cryptoKeyDecrypter",
-		},
-		&cloudkms.Binding{
-			Members: []string{"serviceAccount:" + serviceAccount},
-			Role:    "roles/cloudkms.cryptoKeyEncrypter",
-		},
+	labels, err := KeyLabels(user)
+	if err != nil {
+		return "", err
 	}
 
-	// Policy request
-	polreq := cloudkms.SetIamPolicyRequest{
-		Policy: &pol,
+	// If the key exists, it was created by an earlier run which didn't
+	// get as far as recording it.
+	err = km.CreateKey(resourceName, spec, labels)
+	if err != nil {
+		return "", err
 	}
 
-	// Work out crypto key resource name.
-	template = "projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s"
-	resourceName = fmt.Sprintf(template, projectID, "global", keyRing,
-		cryptoKey)
+	return resourceName, nil
+
+}
+
+// Reports the drift between desired and actual policy for every user's key.
+// Users are found from their directories in the bucket.  Keys in the key
+// rings users' keys are in, or new keys would be created in, which don't
+// belong to any user are reported too.
+func reportDrift(svc *cloudkms.Service, ssvc ObjectStore) error {
 
-	fmt.Println("Set IAM policy on crypto key...")
-	// Set IAM policy on crypto key.
-	_, err = svc.Projects.Locations.KeyRings.CryptoKeys.
-		SetIamPolicy(resourceName, &polreq).Do()
+	serviceAccount := Getenv("SERVICE_ACCOUNT", "")
+	bucket := Getenv("BUCKET", "")
+
+	all, err := ListUsers(ssvc, bucket)
 	if err != nil {
-		fmt.Printf("CryptoKey SetIamPolicy failed: %s\n",
-			err.Error())
 		return err
 	}
 
-	fmt.Println("Success.")
+	// Users, by key resource name.
+	users := map[string]string{}
+	for _, user := range all {
+		name, err := ResolveKeyName(ssvc, user)
+		if err != nil {
+			return err
+		}
+		users[name] = user
+	}
+
+	rings := map[string]bool{
+		KeyRingName("global"):                         true,
+		KeyRingName(Getenv("KMS_LOCATION", "global")): true,
+	}
+
+	drift := 0
+
+	// A key record which doesn't name a key can't be checked.
+	for name, user := range users {
+		i := strings.Index(name, "/cryptoKeys/")
+		if i < 0 {
+			drift++
+			fmt.Printf("%s: malformed key record %s\n", user, name)
+			delete(users, name)
+			continue
+		}
+		rings[name[:i]] = true
+	}
+
+	for ringName := range rings {
+
+		err = svc.Projects.Locations.KeyRings.CryptoKeys.List(ringName).Pages(
+			context.Background(), func(keys *cloudkms.ListCryptoKeysResponse) error {
+
+				for _, k := range keys.CryptoKeys {
+
+					user, ok := users[k.Name]
+					if !ok {
+						fmt.Printf("%s: no user\n", k.Name)
+						continue
+					}
+					delete(users, k.Name)
+
+					pol, err := getPolicy(svc, k.Name)
+					if err != nil {
+						return err
+					}
+
+					isSa := strings.HasSuffix(user, ".gserviceaccount.com")
+					missing, extra := policyDrift(pol,
+						desiredBindings(user, isSa, serviceAccount))
+
+					if len(missing) == 0 && len(extra) == 0 {
+						fmt.Printf("%s: ok\n", user)
+						continue
+					}
+
+					if len(missing) > 0 {
+						drift++
+					}
+
+					for _, role := range sortedKeys(missing) {
+						fmt.Printf("%s: missing %s %s\n", user, role,
+							strings.Join(missing[role], ","))
+					}
+					for _, role := range sortedKeys(extra) {
+						fmt.Printf("%s: extra %s %s\n", user, role,
+							strings.Join(extra[role], ","))
+					}
+
+				}
+
+				return nil
+
+			})
+		if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+			// No key ring in that location.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+	}
+
+	for _, user := range users {
+		drift++
+		fmt.Printf("%s: no key\n", user)
+	}
+
+	if drift > 0 {
+		return fmt.Errorf("%d keys missing required bindings", drift)
+	}
 
 	return nil
 
 }
 
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func main() {
 
-	if len(os.Args) < 3 {
+	report := flag.Bool("report", false,
+		"Report policy drift for every user's key, rather than set up "+
+			"one user")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 1 || (!*report && len(args) < 2) {
 		fmt.Println("Usage:")
 		fmt.Println("  setup-ckms <key> <user> [<isSa>]")
 		fmt.Println("    isSa=yes|no")
+		fmt.Println("  setup-ckms -report <key>")
 		os.Exit(1)
 	}
 
 	// Get environment variables.
-	keyfile := os.Args[1]
+	keyfile := args[0]
 
 	// Read the key file
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		fmt.Printf("Couldn't read key file: %s\n",
-			err.Error())
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
+	}
+
+	if *report {
+
+		// Policies are Cloud KMS IAM policies.
+		svc, err := CloudKMSSignin(key)
+		if err != nil {
+			Log.Error("Couldn't connect", "error", err)
+			os.Exit(1)
+		}
+
+		ssvc, err := ObjectStoreSignin(key)
+		if err != nil {
+			Log.Error("Couldn't connect", "error", err)
+			os.Exit(1)
+		}
+
+		err = reportDrift(svc, ssvc)
+		if err != nil {
+			Log.Error("Policy drift", "error", err)
+			os.Exit(1)
+		}
+
 		return
+
 	}
 
-	user := os.Args[2]
+	user := args[1]
 
 	isSa := false
-	if len(os.Args) > 3 {
-		if os.Args[3] == "yes" {
+	if len(args) > 2 {
+		if args[2] == "yes" {
 			isSa = true
 		}
 	}
 
-	svc, err := CloudKMSSignin(key)
+	km, err := KeyManagerSignin(key)
 	if err != nil {
-		fmt.Printf("Couldn't connect: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
 	}
 
-	initialiseKms(svc, user, isSa)
+	ssvc, err := ObjectStoreSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
+
+	err = initialiseKms(km, ssvc, user, isSa)
+	if err != nil {
+		os.Exit(1)
+	}
 
 }
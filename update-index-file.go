@@ -2,145 +2,133 @@
 
 	update-index.go
 
-	Write data to storage avoiding potential race-condition using Google's
-	if-generation-match checks.
+	Write data to storage avoiding potential race-condition using
+	if-generation-match checks, which every ObjectStore backend provides,
+	see UpdateObject.
 
-	NOTE: this code is specifically for Google Storage. Porting required if using with
-	other cloud storage.
+	Adds or replaces an INDEX entry by its type and device or name, or
+	removes the entries of a type whose fields match exactly.  Values are
+	given as field=value arguments, so they needn't be quoted as JSON.
 
 *********************************************************************************************/
 
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"math"
-	"math/big"
 	"os"
 	"strings"
-	"time"
 )
 
-// Multiple request retries
-// Cloud Storage is a distributed system. Because requests can fail due to network or service conditions,
-// Google recommends that you retry failures with exponential backoff. However, due to the nature of
-// distributed systems, sometimes these retries can cause surprising behavior.
-// https://cloud.google.com/storage/docs/exponential-backoff
-
-func backoff(i float64) time.Duration {
-	// Use crypt random to ensure source is good (not needed for security,
-	// but better than seeding on time, which wouldn't avoid the clash we're using the backoff for...)
-	randMilliSecs, _ := rand.Int(rand.Reader, big.NewInt(1000))
-	// waitTime in milliseconds for precision
-	// Add some jitter to avoid clashes with other backed-off attempts.
-	waitTime := (time.Duration(math.Pow(2, i)) * time.Second) +
-		(time.Duration(randMilliSecs.Int64()) * time.Millisecond)
-	time.Sleep(waitTime)
-	return waitTime
+// Parses field=value arguments.
+func parseFields(args []string) (map[string]string, error) {
+
+	fields := map[string]string{}
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i < 1 {
+			return nil, errors.New("Expected field=value: " + arg)
+		}
+		fields[arg[:i]] = arg[i+1:]
+	}
+
+	return fields, nil
+
 }
 
 func main() {
 	// Parse arguments
-	if len(os.Args) != 6 {
+	indexFile := flag.String("index", "INDEX", "Name of the index file")
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 5 || (args[2] != "put" && args[2] != "remove") {
 		fmt.Fprintln(os.Stderr, "Usage:")
 		fmt.Fprintln(os.Stderr,
-			"  update-index <key> <user> <line to remove> <replacement line> <index file>")
+			"  update-index-file [-index <file>] <key> <user> put <type> <field>=<value>...")
+		fmt.Fprintln(os.Stderr,
+			"  update-index-file [-index <file>] <key> <user> remove <type> <field>=<value>...")
 		os.Exit(1)
 	}
 
 	// Get environment variables.
-	keyfile := os.Args[1]
+	keyfile := args[0]
 
 	// Read the key file
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't read key file: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
 	}
 
-	user := os.Args[2]
+	user := args[1]
+	command := args[2]
+	kind := args[3]
 
-	lineToRemove := os.Args[3]
-	replacementLine := os.Args[4]
-	indexFile := os.Args[5]
-
-	// Download data to edit
-	svc, err := StorageSignin(key)
+	fields, err := parseFields(args[4:])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't connect: %s\n",
-			err.Error())
-		return
+		Log.Error("Bad arguments", "error", err)
+		os.Exit(1)
 	}
 
-	fmt.Fprintf(os.Stderr, "Connected.\n")
-
-	bucket := Getenv("BUCKET", "")
-	path := user + "/" + indexFile
+	// Check the entry before touching anything.
+	var entry IndexEntry
+	if command == "put" {
+		entry, err = NewIndexEntry(kind, fields)
+		if err != nil {
+			Log.Error("Bad entry", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	// Download data, edit data, upload new data.
-	// Re-try with exponential backoff
+	svc, err := ObjectStoreSignin(key)
+	if err != nil {
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
+	}
 
-	// Backoff set-up
-	elapsedTime := time.Duration(0)
-	backoffTime := time.Duration(32) * time.Second
-	i := float64(0)
-	for elapsedTime < backoffTime {
-		// Whilst within re-try period...
+	Log.Info("Connected")
 
-		// Get generation info
-		var generation int64
-		err = GetGeneration(svc, bucket, path, &generation)
+	bucket := Getenv("BUCKET", "")
+	path := user + "/" + *indexFile
 
-		// Get data to edit
-		var downloadedData bytes.Buffer // TODO: is this the correct writer?
-		err = Download(svc, bucket, path, &downloadedData)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Couldn't download: %s\n",
-				err.Error())
-			return
-		}
+	// Edit the index, entries are matched exactly, by type and device or
+	// name when adding, by the fields given when removing.  A user's first
+	// entry creates their index.
+	err = UpdateObject(svc, user, bucket, path,
+		func(data []byte, exists bool) ([]byte, error) {
 
-		// Edit data
-		downloadedLines := strings.Split(downloadedData.String(), "\n")
-		var content string
-		// Skip any lines (i.e. keys) that match the device for which we are updating
-		for _, line := range downloadedLines {
-			if !strings.Contains(line, lineToRemove) && line != "" {
-				content += line
-				content += "\n"
+			index, err := ParseIndex(data)
+			if err != nil {
+				return nil, err
 			}
-		}
-		// Note: replacementLine must be added as a single line
-
-		if replacementLine != "" {
-			content += replacementLine
-		}
 
-		// Attempt to upload updated data
-		// (iff we haven't lost race, otherwise re-try with exponential backoff)
-		// Upload adds ifGenerationMatch flag
+			if command == "put" {
+				replaced := index.Put(entry)
+				Log.Info("Put entry", "type", kind, "id", entry.ID(),
+					"replaced", replaced)
+				return index.Marshal()
+			}
 
-		reader := bytes.NewReader([]byte(content))
+			removed, err := index.Remove(kind, fields)
+			if err != nil {
+				return nil, err
+			}
+			Log.Info("Removed entries", "type", kind, "count", removed)
 
-		err = Upload(svc, user, bucket, path, reader, generation)
-		if err != nil {
-			fmt.Printf("Couldn't upload: %s\n",
-				err.Error())
-			// 412 is generation mis-match so we'll re-try, otherwise we'll give up immediately
-			if !strings.Contains(string(err.Error()), "412") {
-				break
+			if removed == 0 {
+				return nil, ErrUnchanged
 			}
-		} else {
-			// Success - stop trying
-			break
-		}
 
-		// Upload failed, backoff
-		elapsedTime += backoff(i)
-		i += 1.0
+			return index.Marshal()
+
+		})
+	if err != nil {
+		// Let the caller know the index wasn't updated.
+		Log.Error("Couldn't update index", "error", err)
+		os.Exit(1)
 	}
 }
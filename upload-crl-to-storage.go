@@ -6,28 +6,14 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-
-	"google.golang.org/api/storage/v1"
 )
 
-func uploadCRL(svc *storage.Service, bucket string, destFile string, reader io.Reader) error {
-
-	var object storage.Object
-	object.Name = destFile
-	object.Kind = "storage#object"
-	object.CacheControl = "private, max-age=0, no-transform"
-	object.ContentType = "application/pkix-crl"
-
-	obj, err := svc.Objects.Insert(bucket, &object).
-		Media(reader).Do()
-
-	if err != nil {
-		return err
-	}
-
-	fmt.Println("Created object " + obj.Id)
+func uploadCRL(svc ObjectStore, bucket string, destFile string, reader io.Reader) error {
 
-	return nil
+	return svc.Put(bucket, destFile, reader, -1, &ObjectAttrs{
+		CacheControl: "private, max-age=0, no-transform",
+		ContentType:  "application/pkix-crl",
+	})
 }
 
 func main() {
@@ -44,8 +30,7 @@ func main() {
 	// Read the key file
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		fmt.Printf("Couldn't read key file: %s\n",
-			err.Error())
+		Log.Error("Couldn't read key file", "error", err)
 		return
 	}
 
@@ -54,28 +39,25 @@ func main() {
 	// Read the content file
 	content, err := ioutil.ReadFile(os.Args[3])
 	if err != nil {
-		fmt.Printf("Couldn't read content file: %s\n",
-			err.Error())
+		Log.Error("Couldn't read content file", "error", err)
 		return
 	}
 
 	destFile := os.Args[4]
 
-	svc, err := StorageSignin(key)
+	svc, err := ObjectStoreSignin(key)
 	if err != nil {
-		fmt.Printf("Couldn't connect: %s\n",
-			err.Error())
+		Log.Error("Couldn't connect", "error", err)
 		return
 	}
 
-	fmt.Printf("Connected.\n")
+	Log.Info("Connected")
 
 	reader := bytes.NewReader(content)
 
 	err = uploadCRL(svc, bucket, destFile, reader)
 	if err != nil {
-		fmt.Printf("Couldn't upload: %s\n",
-			err.Error())
+		Log.Error("Couldn't upload", "error", err)
 		return
 	}
 
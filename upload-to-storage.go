@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -21,41 +20,37 @@ func main() {
 	// Read the key file
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		fmt.Printf("Couldn't read key file: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't read key file", "error", err)
+		os.Exit(1)
 	}
 
 	user := os.Args[2]
 
-	// Read the key file
-	content, err := ioutil.ReadFile(os.Args[3])
+	// Content is streamed, it may be large.
+	content, err := os.Open(os.Args[3])
 	if err != nil {
-		fmt.Printf("Couldn't read content file: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't read content file", "error", err)
+		os.Exit(1)
 	}
+	defer content.Close()
 
 	filename := os.Args[4]
 
-	svc, err := StorageSignin(key)
+	svc, err := ObjectStoreSignin(key)
 	if err != nil {
-		fmt.Printf("Couldn't connect: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't connect", "error", err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("Connected.\n")
+	Log.Info("Connected")
 
-	reader := bytes.NewReader(content)
 	bucket := Getenv("BUCKET", "")
 	path := user + "/" + filename
 
-	err = Upload(svc, user, bucket, path, reader, -1)
+	err = Upload(svc, user, bucket, path, content, -1)
 	if err != nil {
-		fmt.Printf("Couldn't upload: %s\n",
-			err.Error())
-		return
+		Log.Error("Couldn't upload", "error", err)
+		os.Exit(1)
 	}
 
 }